@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"flag"
 	"encoding/json"
-	"strconv"
 	"log"
 	"strings"
 	"io/ioutil"
@@ -12,6 +11,7 @@ import (
 	"github.com/MaryLynJuana/KPI_Load_Balancer/httptools"
 	"github.com/MaryLynJuana/KPI_Load_Balancer/datastore"
 	"github.com/MaryLynJuana/KPI_Load_Balancer/signal"
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
 )
 
 type valueString struct {
@@ -23,12 +23,22 @@ type valueInt64 struct {
 
 var port = flag.Int("port", 8079, "database port")
 
+var spansFile = flag.String("spans-file", "", "file to export trace spans to as JSON lines")
+var otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export trace spans to")
+
 func main() {
+	flag.Parse()
 	db, err := datastore.NewDb("/tmp")
 	if err != nil {
 		log.Fatalf("Error creating database: %s", err)
 	}
 
+	exporter, err := tracing.NewExporter(*spansFile, *otlpEndpoint, "db")
+	if err != nil {
+		log.Fatalf("Error creating span exporter: %s", err)
+	}
+	tracer := &tracing.Tracer{Service: "db", Exporter: exporter}
+
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/db/", func(rw http.ResponseWriter, r *http.Request) {
@@ -45,7 +55,7 @@ func main() {
 			var vi valueInt64
 			err = json.Unmarshal(body, &vi)
 			if err == nil {
-				log.Println(strconv.FormatInt(vi.Value, 10))
+				tracing.Logf(r.Context(), "%d", vi.Value)
 				err = db.PutInt64(key, vi.Value)
 				if err != nil {
 					rw.WriteHeader(http.StatusNotFound)
@@ -55,7 +65,7 @@ func main() {
 
 				var vs valueString
 				err = json.Unmarshal(body, &vs)
-				log.Println(vs.Value)
+				tracing.Logf(r.Context(), "%s", vs.Value)
 				if err != nil {
 					log.Fatalf("Error decoding request data: %s", err)
 					rw.WriteHeader(http.StatusBadRequest)
@@ -109,7 +119,7 @@ func main() {
 			}
 		}
 	})
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, tracer.Middleware(h))
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
\ No newline at end of file
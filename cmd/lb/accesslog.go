@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
+)
+
+type accessEntry struct {
+	mu sync.Mutex
+
+	Time        string  `json:"time"`
+	RequestID   string  `json:"request_id,omitempty"`
+	TraceID     string  `json:"trace_id,omitempty"`
+	ClientIP    string  `json:"client_ip"`
+	Method      string  `json:"method"`
+	Host        string  `json:"host"`
+	Path        string  `json:"path"`
+	Status      int     `json:"status"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+	Backend     string  `json:"backend,omitempty"`
+	Attempts    int     `json:"attempts"`
+	UpstreamMs  float64 `json:"upstream_latency_ms"`
+	TotalMs     float64 `json:"total_latency_ms"`
+	sampled     bool
+	requestSize *countingBody
+}
+
+type contextKey int
+
+const (
+	accessEntryKey contextKey = iota
+	debugInfoKey
+)
+
+func entryFrom(ctx context.Context) *accessEntry {
+	e, _ := ctx.Value(accessEntryKey).(*accessEntry)
+	return e
+}
+
+// startAttempt counts a request sent to a backend.
+func (e *accessEntry) startAttempt() {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Attempts++
+}
+
+// responded records the first backend that answered, which is the one whose
+// response is returned to the client.
+func (e *accessEntry) responded(dst string, latency time.Duration) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.Backend == "" {
+		e.Backend = dst
+		e.UpstreamMs = milliseconds(latency)
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// accessLogger writes one JSON line per request. Only a sample of successful
+// requests is logged, server errors are always logged.
+type accessLogger struct {
+	out    io.Writer
+	sample float64
+	mu     sync.Mutex
+}
+
+func (l *accessLogger) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessEntry{
+			Time:      start.UTC().Format(time.RFC3339Nano),
+			RequestID: r.Header.Get(tracing.RequestIDHeader),
+			ClientIP:  clientIP(r),
+			Method:    r.Method,
+			Host:      r.Host,
+			Path:      r.URL.Path,
+			sampled:   rand.Float64() < l.sample,
+		}
+		if span := tracing.FromContext(r.Context()); span != nil {
+			e.TraceID = span.TraceID
+		}
+		if r.Body != nil {
+			e.requestSize = &countingBody{ReadCloser: r.Body}
+			r.Body = e.requestSize
+		}
+		sw := &statusWriter{ResponseWriter: rw}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), accessEntryKey, e)))
+
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		e.Status = sw.status
+		e.BytesOut = sw.bytes
+		if e.requestSize != nil {
+			e.BytesIn = e.requestSize.n
+		}
+		e.TotalMs = milliseconds(time.Since(start))
+		if e.sampled || e.Status >= http.StatusInternalServerError {
+			l.write(e)
+		}
+	})
+}
+
+func (l *accessLogger) write(e *accessEntry) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("Failed to encode access log entry: %s", err)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write access log: %s", err)
+	}
+}
+
+// rotatingFile is an append-only file that is renamed to path.1, path.2, ...
+// once it grows over maxSize bytes, keeping at most backups old files.
+type rotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := f.backups - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.backups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func newAccessLogger() (*accessLogger, error) {
+	switch *accessLogPath {
+	case "":
+		return nil, nil
+	case "-":
+		return &accessLogger{out: os.Stdout, sample: *accessLogSample}, nil
+	}
+	f, err := openRotatingFile(*accessLogPath, *accessLogMaxSizeMB<<20, *accessLogBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{out: f, sample: *accessLogSample}, nil
+}
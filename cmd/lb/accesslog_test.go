@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out, sample: 1}
+	handler := l.wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		e := entryFrom(r.Context())
+		e.startAttempt()
+		e.startAttempt()
+		e.responded("server2:8080", 5*time.Millisecond)
+		e.responded("server1:8080", 10*time.Millisecond)
+		rw.WriteHeader(http.StatusCreated)
+		_, _ = rw.Write([]byte("created"))
+	}))
+
+	r := httptest.NewRequest("POST", "http://balancer/api/v1/some-data", strings.NewReader("payload"))
+	r.Header.Set("X-Request-ID", "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	var e map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &e); err != nil {
+		t.Fatalf("Access log is not JSON: %s (%q)", err, out.String())
+	}
+	expected := map[string]interface{}{
+		"request_id": "abc",
+		"client_ip":  "192.0.2.1",
+		"method":     "POST",
+		"host":       "balancer",
+		"path":       "/api/v1/some-data",
+		"status":     float64(201),
+		"bytes_in":   float64(7),
+		"bytes_out":  float64(7),
+		"backend":    "server2:8080",
+		"attempts":   float64(2),
+	}
+	for k, v := range expected {
+		if e[k] != v {
+			t.Errorf("Unexpected %s: %v, expected %v", k, e[k], v)
+		}
+	}
+	if e["upstream_latency_ms"] != float64(5) {
+		t.Errorf("Unexpected upstream latency %v", e["upstream_latency_ms"])
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var out bytes.Buffer
+	l := &accessLogger{out: &out, sample: 0}
+	status := http.StatusOK
+	handler := l.wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(status)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if out.Len() != 0 {
+		t.Errorf("Unsampled request was logged")
+	}
+	status = http.StatusBadGateway
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if out.Len() == 0 {
+		t.Errorf("Server error was not logged")
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	f, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		data, err := ioutil.ReadFile(path + name)
+		if err != nil || string(data) != expected {
+			t.Errorf("Unexpected content of access.log%s: %q (%v)", name, data, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Too many backups kept")
+	}
+}
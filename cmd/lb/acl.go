@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ipACL denies clients matching deny and, when allow is not empty, clients
+// that match none of allow.
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", v)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newIPACL(allow, deny []string) (*ipACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	acl := &ipACL{}
+	var err error
+	if acl.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if acl.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ipACL) allows(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if ip == nil || containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
+
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []*net.IPNet
+)
+
+func setTrustedProxies(nets []*net.IPNet) {
+	trustedProxiesMu.Lock()
+	defer trustedProxiesMu.Unlock()
+	trustedProxies = nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+	return ip != nil && containsIP(trustedProxies, ip)
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// honored when the request comes from a trusted proxy, and then the rightmost
+// address that is not a trusted proxy is the client.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !isTrustedProxy(net.ParseIP(host)) {
+		return host
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		ip := net.ParseIP(hop)
+		if ip == nil {
+			break
+		}
+		host = hop
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// reloadACL re-reads the access lists and trusted proxies from the config
+// file. Other settings need a restart.
+func reloadACL() error {
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	trusted, err := parseCIDRs(conf.TrustedProxies)
+	if err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	acls := map[*route]*ipACL{}
+	for _, rc := range conf.Routes {
+		rt := routeByPrefix(rc.Prefix)
+		if rt == nil {
+			return fmt.Errorf("route %q is not configured, restart to add it", rc.Prefix)
+		}
+		if acls[rt], err = newIPACL(rc.Allow, rc.Deny); err != nil {
+			return fmt.Errorf("route %q: %w", rc.Prefix, err)
+		}
+	}
+	setTrustedProxies(trusted)
+	for _, rt := range routes {
+		rt.setACL(acls[rt])
+	}
+	return nil
+}
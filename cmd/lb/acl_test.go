@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPACL(t *testing.T) {
+	acl, err := newIPACL([]string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, allowed := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+	} {
+		if acl.allows(net.ParseIP(ip)) != allowed {
+			t.Errorf("Unexpected decision for %s, expected %t", ip, allowed)
+		}
+	}
+	if _, err := newIPACL([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("Invalid CIDR accepted")
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	trusted, _ := parseCIDRs([]string{"172.19.0.0/16"})
+	setTrustedProxies(trusted)
+	defer setTrustedProxies(nil)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	if ip := clientIP(r); ip != "192.0.2.1" {
+		t.Errorf("X-Forwarded-For from untrusted peer honored: %s", ip)
+	}
+
+	r.RemoteAddr = "172.19.0.5:4000"
+	r.Header.Set("X-Forwarded-For", "6.6.6.6, 1.2.3.4, 172.19.0.9")
+	if ip := clientIP(r); ip != "1.2.3.4" {
+		t.Errorf("Unexpected client IP behind trusted proxies: %s", ip)
+	}
+}
+
+func TestReloadACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lb.json")
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"pools": [{"name": "servers", "servers": ["server1:8080"]}],
+		"routes": [{"prefix": "/", "pool": "servers"}, {"prefix": "/report", "pool": "servers"}]}`)
+
+	defer func(path string, original []*route) { *configPath, routes = path, original }(*configPath, routes)
+	*configPath = path
+	conf, _ := loadConfig(path)
+	routes = mustBuildRoutes(conf, mustBuildPools(conf))
+
+	write(`{"pools": [{"name": "servers", "servers": ["server1:8080"]}],
+		"routes": [{"prefix": "/", "pool": "servers"}, {"prefix": "/report", "pool": "servers", "allow": ["10.0.0.0/8"]}]}`)
+	if err := reloadACL(); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/report", nil))
+	if rw.Code != http.StatusForbidden {
+		t.Errorf("Expected forbidden response, got %d", rw.Code)
+	}
+	if n := counterValue("lb_access_denied_total", "route", "/report"); n != 1 {
+		t.Errorf("Unexpected denied count %d", n)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type routeWeights struct {
+	Prefix  string         `json:"prefix"`
+	Weights map[string]int `json:"weights"`
+}
+
+func adminHandler() http.Handler {
+	api := new(http.ServeMux)
+	api.HandleFunc("/routes", handleRoutes)
+	api.HandleFunc("/acl/reload", handleACLReload)
+	api.HandleFunc("/cache/purge", handleCachePurge)
+	api.HandleFunc("/registry", handleRegistry)
+	api.HandleFunc("/maintenance", handleMaintenance)
+
+	h := new(http.ServeMux)
+	h.HandleFunc("/metrics", serveMetrics)
+	h.Handle("/", requireAdminToken(api))
+	return h
+}
+
+// requireAdminToken lets through only requests with the admin token as a
+// bearer token, as the API changes where production traffic goes.
+func requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if *adminToken == "" {
+			http.Error(rw, "admin API is disabled without -admin-token", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(rw, "invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// handleRoutes lists the traffic split of every route on GET and changes the
+// weights of one route on PUT.
+func handleRoutes(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]routeWeights, len(routes))
+		for i, rt := range routes {
+			list[i] = routeWeights{Prefix: rt.prefix, Weights: rt.weights()}
+		}
+		writeJSON(rw, http.StatusOK, list)
+	case http.MethodPut:
+		var update routeWeights
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rt := routeByPrefix(update.Prefix)
+		if rt == nil {
+			http.Error(rw, "unknown route", http.StatusNotFound)
+			return
+		}
+		if err := rt.setWeights(update.Weights); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(rw, http.StatusOK, routeWeights{Prefix: rt.prefix, Weights: rt.weights()})
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handleACLReload(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err := reloadACL(); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// handleCachePurge removes cached responses of ?key=/path?query or of all
+// keys starting with ?prefix=.
+func handleCachePurge(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if cache == nil {
+		http.Error(rw, "caching is disabled", http.StatusNotFound)
+		return
+	}
+	key, prefix := r.URL.Query().Get("key"), r.URL.Query().Get("prefix")
+	if key == "" && prefix == "" {
+		http.Error(rw, "key or prefix is required", http.StatusBadRequest)
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]int{"purged": cache.purge(key, prefix)})
+}
+
+// handleRegistry lists registered backends on GET, registers a backend or
+// takes its heartbeat on PUT and deregisters ?pool=&address= on DELETE.
+func handleRegistry(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, backendRegistry.list())
+	case http.MethodPut:
+		var reg registration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := backendRegistry.register(reg, time.Now()); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, errStaticBackend) || errors.Is(err, errDraining) {
+				status = http.StatusConflict
+			}
+			http.Error(rw, err.Error(), status)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		q := r.URL.Query()
+		if err := backendRegistry.deregister(q.Get("pool"), q.Get("address")); err != nil {
+			http.Error(rw, err.Error(), http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusAccepted)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+type maintenanceUpdate struct {
+	Route string `json:"route,omitempty"`
+	Pool  string `json:"pool,omitempty"`
+	maintenanceState
+}
+
+// handleMaintenance lists the maintenance state of routes and pools on GET
+// and puts a route or a pool into or out of maintenance on PUT.
+func handleMaintenance(rw http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list := []maintenanceUpdate{}
+		for _, rt := range routes {
+			list = append(list, maintenanceUpdate{Route: rt.prefix, maintenanceState: rt.maintenance.state()})
+		}
+		for _, p := range pools {
+			list = append(list, maintenanceUpdate{Pool: p.name, maintenanceState: p.maintenance.state()})
+		}
+		writeJSON(rw, http.StatusOK, list)
+	case http.MethodPut:
+		var update maintenanceUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var m *maintenance
+		if rt := routeByPrefix(update.Route); update.Route != "" && rt != nil {
+			m = rt.maintenance
+		} else if p := poolByName(pools, update.Pool); update.Pool != "" && p != nil {
+			m = p.maintenance
+		}
+		if m == nil {
+			http.Error(rw, "unknown route or pool", http.StatusNotFound)
+			return
+		}
+		m.set(update.maintenanceState)
+		update.maintenanceState = m.state()
+		writeJSON(rw, http.StatusOK, update)
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("content-type", "application/json")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	authSubjectHeader = "X-Auth-Subject"
+	authMethodHeader  = "X-Auth-Method"
+	authClaimPrefix   = "X-Auth-Claim-"
+
+	defaultAPIKeyHeader = "X-API-Key"
+)
+
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+type identity struct {
+	subject string
+	method  string
+	claims  map[string]string
+}
+
+// authenticator checks the credentials a request carries: a bearer JWT, HTTP
+// basic auth or a static API key, whichever of them is configured.
+type authenticator struct {
+	realm        string
+	apiKeyHeader string
+	apiKeys      map[[sha256.Size]byte]string
+	users        map[string][]byte
+	jwt          *jwtVerifier
+}
+
+type jwtVerifier struct {
+	algorithm string
+	secret    []byte
+	publicKey *rsa.PublicKey
+	issuer    string
+	audience  string
+	claims    []string
+	leeway    time.Duration
+}
+
+func newAuthenticator(c *authConfig) (*authenticator, error) {
+	a := &authenticator{realm: c.Realm, apiKeyHeader: c.APIKeyHeader}
+	if a.realm == "" {
+		a.realm = "balancer"
+	}
+	if a.apiKeyHeader == "" {
+		a.apiKeyHeader = defaultAPIKeyHeader
+	}
+	if c.APIKeysFile != "" {
+		keys, err := readPairs(c.APIKeysFile, " ")
+		if err != nil {
+			return nil, fmt.Errorf("api keys: %w", err)
+		}
+		a.apiKeys = map[[sha256.Size]byte]string{}
+		for key, subject := range keys {
+			a.apiKeys[sha256.Sum256([]byte(key))] = subject
+		}
+	}
+	if c.BasicUsersFile != "" {
+		users, err := readPairs(c.BasicUsersFile, ":")
+		if err != nil {
+			return nil, fmt.Errorf("basic users: %w", err)
+		}
+		a.users = map[string][]byte{}
+		for user, hash := range users {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("basic users: %s: %w", user, err)
+			}
+			a.users[user] = []byte(hash)
+		}
+	}
+	if c.JWT != nil {
+		v, err := newJWTVerifier(c.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: %w", err)
+		}
+		a.jwt = v
+	}
+	if a.apiKeys == nil && a.users == nil && a.jwt == nil {
+		return nil, fmt.Errorf("no authentication method configured")
+	}
+	return a, nil
+}
+
+// readPairs reads "name<sep>value" lines, skipping blanks and # comments.
+func readPairs(path, sep string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pairs := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		parts := strings.SplitN(text, sep, 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("%s:%d: malformed line", path, line)
+		}
+		pairs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return pairs, scanner.Err()
+}
+
+func newJWTVerifier(c *jwtConfig) (*jwtVerifier, error) {
+	v := &jwtVerifier{
+		algorithm: c.Algorithm,
+		issuer:    c.Issuer,
+		audience:  c.Audience,
+		claims:    c.Claims,
+		leeway:    time.Duration(c.LeewaySec) * time.Second,
+	}
+	key, err := ioutil.ReadFile(c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	switch c.Algorithm {
+	case "HS256":
+		v.secret = []byte(strings.TrimRight(string(key), "\r\n"))
+		if len(v.secret) == 0 {
+			return nil, fmt.Errorf("empty secret in %s", c.KeyFile)
+		}
+	case "RS256":
+		if v.publicKey, err = parseRSAPublicKey(key); err != nil {
+			return nil, fmt.Errorf("%s: %w", c.KeyFile, err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", c.Algorithm)
+	}
+	return v, nil
+}
+
+func parseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data")
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("not an RSA public key")
+}
+
+func (a *authenticator) authenticate(r *http.Request) (*identity, error) {
+	authorization := r.Header.Get("Authorization")
+	switch {
+	case a.jwt != nil && strings.HasPrefix(authorization, "Bearer "):
+		return a.jwt.verify(strings.TrimPrefix(authorization, "Bearer "), time.Now())
+	case a.users != nil && strings.HasPrefix(authorization, "Basic "):
+		user, password, _ := r.BasicAuth()
+		hash, ok := a.users[user]
+		if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+			return nil, errUnauthenticated
+		}
+		return &identity{subject: user, method: "basic"}, nil
+	case a.apiKeys != nil && r.Header.Get(a.apiKeyHeader) != "":
+		subject, ok := a.apiKeys[sha256.Sum256([]byte(r.Header.Get(a.apiKeyHeader)))]
+		if !ok {
+			return nil, errUnauthenticated
+		}
+		return &identity{subject: subject, method: "api-key"}, nil
+	}
+	return nil, errUnauthenticated
+}
+
+func (a *authenticator) challenge(h http.Header) {
+	if a.users != nil {
+		h.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.realm))
+	}
+	if a.jwt != nil {
+		h.Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", a.realm))
+	}
+}
+
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func (v *jwtVerifier) verify(token string, now time.Time) (*identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errUnauthenticated
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Algorithm != v.algorithm {
+		return nil, errUnauthenticated
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errUnauthenticated
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	digest := sha256.Sum256(signed)
+	switch v.algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errUnauthenticated
+		}
+	case "RS256":
+		if rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errUnauthenticated
+		}
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errUnauthenticated
+	}
+	unix := float64(now.Unix())
+	leeway := v.leeway.Seconds()
+	if claims.ExpiresAt == nil || unix > *claims.ExpiresAt+leeway {
+		return nil, fmt.Errorf("%w: token expired", errUnauthenticated)
+	}
+	if claims.NotBefore != nil && unix < *claims.NotBefore-leeway {
+		return nil, fmt.Errorf("%w: token not valid yet", errUnauthenticated)
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer", errUnauthenticated)
+	}
+	if v.audience != "" && !hasAudience(claims.Audience, v.audience) {
+		return nil, fmt.Errorf("%w: unexpected audience", errUnauthenticated)
+	}
+
+	id := &identity{subject: claims.Subject, method: "jwt", claims: map[string]string{}}
+	if len(v.claims) > 0 {
+		var all map[string]interface{}
+		_ = decodeSegment(parts[1], &all)
+		for _, name := range v.claims {
+			if value, ok := all[name]; ok {
+				id.claims[name] = fmt.Sprint(value)
+			}
+		}
+	}
+	return id, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// hasAudience accepts aud both as a single string and as an array.
+func hasAudience(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripIdentityHeaders removes identity headers sent by clients, so only the
+// balancer can set them.
+func stripIdentityHeaders(h http.Header) {
+	for name := range h {
+		if strings.HasPrefix(name, "X-Auth-") {
+			h.Del(name)
+		}
+	}
+}
+
+// setIdentityHeaders passes the authenticated identity to backends. The
+// subject also replaces lb-author, which the servers use in their reports.
+func setIdentityHeaders(h http.Header, id *identity) {
+	h.Set(authSubjectHeader, id.subject)
+	h.Set(authMethodHeader, id.method)
+	for name, value := range id.claims {
+		h.Set(authClaimPrefix+name, value)
+	}
+	h.Set("lb-author", id.subject)
+}
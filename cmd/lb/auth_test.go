@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestAuthAPIKeyAndBasic(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAuthenticator(&authConfig{
+		APIKeysFile:    writeTestFile(t, "keys", "# key subject\nk-123 reporter\n"),
+		BasicUsersFile: writeTestFile(t, "users", "alice:"+string(hash)+"\n"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.Header.Set("X-API-Key", "k-123")
+	if id, err := a.authenticate(r); err != nil || id.subject != "reporter" || id.method != "api-key" {
+		t.Errorf("API key not accepted: %+v %v", id, err)
+	}
+	r.Header.Set("X-API-Key", "wrong")
+	if _, err := a.authenticate(r); err == nil {
+		t.Errorf("Unknown API key accepted")
+	}
+
+	r = httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.SetBasicAuth("alice", "secret")
+	if id, err := a.authenticate(r); err != nil || id.subject != "alice" || id.method != "basic" {
+		t.Errorf("Basic auth not accepted: %+v %v", id, err)
+	}
+	r.SetBasicAuth("alice", "guess")
+	if _, err := a.authenticate(r); err == nil {
+		t.Errorf("Wrong password accepted")
+	}
+	if _, err := a.authenticate(httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Errorf("Request without credentials accepted")
+	}
+}
+
+func TestAuthJWT(t *testing.T) {
+	secret := []byte("jwt-secret")
+	a, err := newAuthenticator(&authConfig{JWT: &jwtConfig{
+		Algorithm: "HS256",
+		KeyFile:   writeTestFile(t, "secret", "jwt-secret\n"),
+		Issuer:    "auth.example",
+		Audience:  "balancer",
+		Claims:    []string{"role"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := float64(time.Now().Add(time.Minute).Unix())
+	valid := map[string]interface{}{"sub": "bob", "iss": "auth.example", "aud": []string{"other", "balancer"}, "exp": exp, "role": "admin"}
+	id, err := a.jwt.verify(signJWT(t, "HS256", secret, valid), time.Now())
+	if err != nil || id.subject != "bob" || id.claims["role"] != "admin" {
+		t.Errorf("Valid token rejected: %+v %v", id, err)
+	}
+
+	for name, claims := range map[string]map[string]interface{}{
+		"expired":  {"sub": "bob", "iss": "auth.example", "aud": "balancer", "exp": exp - 120},
+		"issuer":   {"sub": "bob", "iss": "evil", "aud": "balancer", "exp": exp},
+		"audience": {"sub": "bob", "iss": "auth.example", "aud": "other", "exp": exp},
+	} {
+		if _, err := a.jwt.verify(signJWT(t, "HS256", secret, claims), time.Now()); err == nil {
+			t.Errorf("Token with bad %s accepted", name)
+		}
+	}
+	if _, err := a.jwt.verify(signJWT(t, "HS256", []byte("other"), valid), time.Now()); err == nil {
+		t.Errorf("Token with bad signature accepted")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	v, err := newJWTVerifier(&jwtConfig{Algorithm: "RS256", KeyFile: writeTestFile(t, "key.pem", string(pub))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := v.verify(signJWT(t, "RS256", key, valid), time.Now()); err != nil || id.subject != "bob" {
+		t.Errorf("Valid RS256 token rejected: %+v %v", id, err)
+	}
+	if _, err := v.verify(signJWT(t, "HS256", secret, valid), time.Now()); err == nil {
+		t.Errorf("Token with unexpected algorithm accepted")
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Auth-Subject", "spoofed")
+	h.Set("X-Auth-Claim-Role", "admin")
+	h.Set("lb-author", "spoofed")
+	stripIdentityHeaders(h)
+	if h.Get("X-Auth-Subject") != "" || h.Get("X-Auth-Claim-Role") != "" {
+		t.Errorf("Client identity headers were not removed: %v", h)
+	}
+	setIdentityHeaders(h, &identity{subject: "bob", method: "jwt", claims: map[string]string{"role": "user"}})
+	if h.Get("lb-author") != "bob" || h.Get("X-Auth-Subject") != "bob" || h.Get("X-Auth-Claim-role") != "user" {
+		t.Errorf("Unexpected identity headers: %v", h)
+	}
+}
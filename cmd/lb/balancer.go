@@ -4,16 +4,21 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"os"
 	"time"
 	"strconv"
 	"strings"
-	"errors"
 
 	"github.com/MaryLynJuana/KPI_Load_Balancer/httptools"
 	"github.com/MaryLynJuana/KPI_Load_Balancer/signal"
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
 )
 
 var (
@@ -22,16 +27,56 @@ var (
 	https = flag.Bool("https", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	spansFile = flag.String("spans-file", "", "file to export trace spans to as JSON lines")
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export trace spans to")
+
+	hedgeRoutes = flag.String("hedge-routes", "", "comma-separated list of idempotent route paths to hedge")
+	hedgeDelay = flag.Duration("hedge-delay", 0, "delay before sending a hedged request, 0 means the observed p95 latency")
+	hedgeBudgetPercent = flag.Float64("hedge-budget", 10, "maximum percentage of hedged route traffic that can be hedged")
+
+	maxConcurrent = flag.Int("max-concurrent", 0, "maximum concurrent requests per backend, 0 means unlimited")
+	queueSize = flag.Int("queue-size", 100, "maximum number of requests waiting for a backend")
+	queueTimeout = flag.Duration("queue-timeout", time.Second, "maximum time a request waits for a backend")
+	adaptiveLimit = flag.Bool("adaptive-limit", false, "whether to adapt the concurrency limit to observed latency")
+	adaptiveLatency = flag.Duration("adaptive-latency", 500*time.Millisecond, "latency above which the adaptive limit is lowered")
+
+	configPath = flag.String("config", "", "path to the JSON balancer configuration")
+	adminPort = flag.Int("admin-port", 8091, "admin API and metrics port")
+	adminToken = flag.String("admin-token", "", "bearer token the admin API requires, the API except /metrics is disabled without it")
+
+	mirrorConcurrency = flag.Int("mirror-concurrency", 10, "maximum number of mirrored requests in flight")
+	accessLogPath = flag.String("access-log", "-", "access log file, - for stdout, empty to disable")
+	accessLogSample = flag.Float64("access-log-sample", 1, "fraction of successful requests written to the access log")
+	accessLogMaxSizeMB = flag.Int64("access-log-max-size", 100, "access log size in megabytes that triggers rotation")
+	accessLogBackups = flag.Int("access-log-backups", 3, "number of rotated access log files to keep")
+
+	localZone = flag.String("zone", "", "zone of the balancer, backends tagged with it are preferred")
+	tagHeader = flag.String("tag-header", "X-Backend-Tags", "request header with key=value backend tags to route by, empty to disable")
+
+	maintenanceMode = flag.Bool("maintenance", false, "whether to start with all routes in maintenance")
+
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "maximum time a deregistered backend finishes its requests")
+
+	acceptProxyProtocol = flag.Bool("accept-proxy-protocol", false, "whether the frontend expects PROXY protocol v1/v2 headers")
+	socket = flag.String("socket", "", "unix socket to accept requests on in addition to the port")
+
+	mirrorMaxBody = flag.Int64("mirror-max-body", 64<<10, "maximum request body size in bytes buffered for mirroring")
+
+	cacheSizeMB = flag.Int64("cache-size", 0, "response cache size in megabytes, 0 disables caching")
+	cacheMaxStale = flag.Duration("cache-max-stale", time.Hour, "how long expired responses are served while no backend can answer")
+
+	compress = flag.Bool("compress", false, "whether to gzip or deflate responses for clients that accept it")
+	compressMinSize = flag.Int("compress-min-size", 1024, "minimum response size in bytes to compress")
+	compressTypes = flag.String("compress-types", "application/json,text/plain,text/html,text/css,application/javascript", "comma-separated content types to compress")
 )
 
+const healthCheckInterval = 10 * time.Second
+
 var (
 	timeout = time.Duration(*timeoutSec) * time.Second
-	serversPool = []string{
-		"server1:8080",
-		"server2:8080",
-		"server3:8080",
-	}
-	serverHealths = []bool{ true, true, true, }
+	tracer = &tracing.Tracer{Service: "lb"}
+	pools = mustBuildPools(&defaultConfig)
+	routes = mustBuildRoutes(&defaultConfig, pools)
 )
 
 func scheme() string {
@@ -41,49 +86,141 @@ func scheme() string {
 	return "http"
 }
 
-func health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+func health(dst string) (bool, *loadReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
-		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+		fmt.Sprintf("%s://%s/health", scheme(), urlHost(dst)), nil)
+	req.Header.Set("Accept", "application/json")
+	resp, err := backendClient.Do(req)
 	if err != nil {
-		return false
+		return false, nil
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return false
+		return false, nil
 	}
-	return true
+	return true, parseLoad(resp)
 }
 
-func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
-	fwdRequest := r.Clone(ctx)
+func roundTrip(ctx context.Context, dst string, r *http.Request) (*http.Response, error) {
+	timing := debugFrom(ctx).attempt(dst)
+	fwdRequest := r.Clone(timing.trace(ctx))
 	fwdRequest.RequestURI = ""
-	fwdRequest.URL.Host = dst
+	fwdRequest.URL.Host = urlHost(dst)
 	fwdRequest.URL.Scheme = scheme()
-	fwdRequest.Host = dst
+	fwdRequest.Host = fwdRequest.URL.Host
+	if rt := matchRoute(routes, r.URL.Path); rt != nil {
+		applyHeaderRules(rt.requestHeaders, fwdRequest.Header, newHeaderVars(r, dst))
+	}
 
-	resp, err := http.DefaultClient.Do(fwdRequest)
-	if err == nil {
-		for k, values := range resp.Header {
-			for _, value := range values {
-				rw.Header().Add(k, value)
+	l := limiterFor(dst)
+	queueStart := time.Now()
+	if err := l.acquire(ctx, *queueTimeout); err != nil {
+		return nil, err
+	}
+	timing.queued(time.Since(queueStart))
+	entry := entryFrom(ctx)
+	entry.startAttempt()
+	span := tracer.Inject(ctx, fwdRequest)
+	span.SetAttribute("backend", dst)
+	start := time.Now()
+	resp, err := backendClient.Do(fwdRequest)
+	if err != nil {
+		l.release(time.Since(start), false)
+		span.SetAttribute("error", err.Error())
+		span.Finish()
+		return nil, err
+	}
+	latency := time.Since(start)
+	entry.responded(dst, latency)
+	span.SetAttribute("status", strconv.Itoa(resp.StatusCode))
+	span.Finish()
+	resp.Body = &releasingBody{
+		ReadCloser: resp.Body,
+		release: func() {
+			l.release(latency, resp.StatusCode < http.StatusInternalServerError)
+		},
+	}
+	return resp, nil
+}
+
+func writeResponse(dst string, rw http.ResponseWriter, resp *http.Response) {
+	for k, values := range resp.Header {
+		if k == http.CanonicalHeaderKey(tracing.RequestIDHeader) && rw.Header().Get(k) != "" {
+			// Already set by the tracing middleware.
+			continue
+		}
+		for _, value := range values {
+			rw.Header().Add(k, value)
+		}
+	}
+	if *traceEnabled {
+		rw.Header().Set("lb-from", dst)
+		debugFrom(resp.Request.Context()).setHeaders(rw.Header(), dst)
+	}
+	if w, ok := rw.(*captureWriter); ok {
+		// The cache applies the rules when it writes the response.
+		w.backend = dst
+	} else {
+		applyResponseRules(rw.Header(), resp.Request, dst)
+	}
+	rw.WriteHeader(resp.StatusCode)
+	defer resp.Body.Close()
+	var err error
+	if f, ok := rw.(http.Flusher); ok && streaming(resp) {
+		err = copyFlushing(rw, f, resp.Body)
+	} else {
+		_, err = io.Copy(rw, resp.Body)
+	}
+	if err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
+
+// streaming tells whether the backend streams the response, e.g. server-sent
+// events, which then reach the client as they come instead of being buffered.
+func streaming(resp *http.Response) bool {
+	if resp.ContentLength >= 0 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/event-stream" || mediaType == "application/x-ndjson")
+}
+
+// copyFlushing copies a streaming body, flushing the headers and every chunk
+// to the client right away.
+func copyFlushing(w io.Writer, f http.Flusher, body io.Reader) error {
+	f.Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return werr
 			}
+			f.Flush()
 		}
-		if *traceEnabled {
-			rw.Header().Set("lb-from", dst)
+		if err == io.EOF {
+			return nil
 		}
-		log.Println("fwd", resp.StatusCode, resp.Request.URL)
-		rw.WriteHeader(resp.StatusCode)
-		defer resp.Body.Close()
-		_, err := io.Copy(rw, resp.Body)
 		if err != nil {
-			log.Printf("Failed to write response: %s", err)
+			return err
 		}
+	}
+}
+
+func forward(dst string, rw http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	resp, err := roundTrip(ctx, dst, r)
+	if err == nil {
+		writeResponse(dst, rw, resp)
 		return nil
 	} else {
 		log.Printf("Failed to get response from %s: %s", dst, err)
-		rw.WriteHeader(http.StatusServiceUnavailable)
+		writeUpstreamError(rw, r, err)
 		return err
 	}
 }
@@ -92,58 +229,239 @@ func hashAddress(addr string) int {
 	ha := strings.Split(strings.Join(strings.Split(addr, "."), ""), ":")[0]
 	hs, err := strconv.Atoi(ha)
 	if (err != nil) {
-		panic(err)
+		// IPv6 and unix socket peers
+		h := fnv.New32a()
+		h.Write([]byte(clientHost(addr)))
+		return int(h.Sum32() & math.MaxInt32)
 	}
 	return hs
 }
 
-func filterHealthy() []string {
-	healthyServersPool := []string{}
-	for i := range serversPool {
-		if (serverHealths[i] == true) {
-			healthyServersPool = append(healthyServersPool, serversPool[i])
-		}
+// clientHost strips the port off a client address, which changes with every
+// connection of the client.
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
-	return healthyServersPool
+	return addr
 }
 
 func balanceRequest(addr string) (string, error) {
-	healthyServersPool := filterHealthy()
-	if (len(healthyServersPool) == 0) {
-		return "", errors.New("No servers available")
-	}
-	addrHash := hashAddress(addr)
-	serverIndex := addrHash % len(healthyServersPool)
-	//log.Println(addr, serverIndex, healthyServersPool[serverIndex])
-	return healthyServersPool[serverIndex], nil
+	return pools[0].balance(addr)
 }
 
 func handleRequest(rw http.ResponseWriter, r *http.Request) {
-	server, err := balanceRequest(r.RemoteAddr)
+	if *traceEnabled {
+		r = withDebugInfo(r)
+	}
+	rt := matchRoute(routes, r.URL.Path)
+	if rt == nil {
+		writeError(rw, r, http.StatusNotFound, errNoRoute, "No route matches the request", 0)
+		return
+	}
+	if !rt.allows(r) {
+		incCounter("lb_access_denied_total", "route", rt.prefix)
+		writeError(rw, r, http.StatusForbidden, errAccessDenied, "Access denied", 0)
+		return
+	}
+	if rt.maintenance.blocks(rw, r) {
+		incCounter("lb_maintenance_responses_total", "route", rt.prefix)
+		return
+	}
+	stripIdentityHeaders(r.Header)
+	if rt.auth != nil {
+		id, err := rt.auth.authenticate(r)
+		if err != nil {
+			incCounter("lb_auth_failures_total", "route", rt.prefix)
+			rt.auth.challenge(rw.Header())
+			writeError(rw, r, http.StatusUnauthorized, errUnauthorized, "Authentication required", 0)
+			return
+		}
+		setIdentityHeaders(r.Header, id)
+	}
+	p := rt.choosePool(r)
+	incCounter("lb_route_requests_total", "route", rt.prefix, "pool", p.name)
+	if p.maintenance.blocks(rw, r) {
+		incCounter("lb_maintenance_responses_total", "pool", p.name)
+		return
+	}
+
+	mirrored := startMirror(rt, r)
+	if mirrored == nil {
+		serveCached(p, rw, r)
+		return
+	}
+	sw := &statusWriter{ResponseWriter: rw}
+	start := time.Now()
+	serveCached(p, sw, r)
+	mirrored <- mirrorResult{status: sw.status, latency: time.Since(start)}
+}
+
+func serve(p *pool, rw http.ResponseWriter, r *http.Request) {
+	b, err := p.pickTagged(r.RemoteAddr, requestTags(r))
 	if (err != nil) {
-		rw.WriteHeader(http.StatusServiceUnavailable)
-		_, _ = rw.Write([]byte("FAILURE"))
+		writeError(rw, r, http.StatusServiceUnavailable, errNoBackend, "No healthy backends available", int(healthCheckInterval.Seconds()))
+		return
+	}
+	debugFrom(r.Context()).picked(p, r.RemoteAddr)
+	b.connect()
+	defer b.disconnect()
+	if shouldHedge(r) {
+		forwardHedged(p, b.addr, rw, r)
 		return
 	}
-	forward(server, rw, r)
+	forward(b.addr, rw, r)
+}
+
+// requestTags reads the backend tags a client asks for from the tag header,
+// e.g. "version=v2".
+func requestTags(r *http.Request) map[string]string {
+	if *tagHeader == "" || r.Header.Get(*tagHeader) == "" {
+		return nil
+	}
+	tags := map[string]string{}
+	for _, pair := range strings.Split(r.Header.Get(*tagHeader), ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return tags
+}
+
+func checkHealth(p *pool, b *backend) {
+	ticker := time.NewTicker(healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		}
+		probeHealth(p, b)
+	}
+}
+
+// checkNewBackend health checks a backend that joined its pool unhealthy
+// right away, so it gets traffic once it passes, and then periodically.
+func checkNewBackend(p *pool, b *backend) {
+	probeHealth(p, b)
+	checkHealth(p, b)
+}
+
+// probeHealth checks the backend once with the health check of its pool.
+func probeHealth(p *pool, b *backend) {
+	var healthy bool
+	if p.healthCheck == healthCheckTCP {
+		healthy = tcpHealth(b.addr)
+	} else {
+		var load *loadReport
+		if healthy, load = health(b.addr); load != nil {
+			b.reportLoad(load.factor())
+		}
+	}
+	if healthy != b.isHealthy() {
+		log.Printf("Backend %s health changed to %t", b.addr, healthy)
+	}
+	b.setHealthy(healthy)
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		probe := flag.Bool("probe", false, "run one health check against every backend")
+		_ = flag.CommandLine.Parse(os.Args[2:])
+		os.Exit(runCheck(*configPath, *probe, os.Stdout))
+	}
 	flag.Parse()
-	for i, server := range serversPool {
-		server := server
-		go func() {
-			for range time.Tick(10 * time.Second) {
-				serverHealths[i] = health(server)
-				log.Println(server, health(server))
-			}
-		}()
+	conf, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatalf("Error loading config: %s", err)
+	}
+	if pools, err = buildPools(conf); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+	if routes, err = buildRoutes(conf, pools); err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+	trusted, err := parseCIDRs(conf.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid config: trusted proxies: %s", err)
+	}
+	if *maintenanceMode {
+		for _, rt := range routes {
+			rt.maintenance.set(maintenanceState{Enabled: true})
+		}
+	}
+	setTrustedProxies(trusted)
+	tcpProxies, err := buildTCPProxies(conf, pools)
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+	initHedging()
+	initMirroring()
+	initCaching()
+	for _, p := range pools {
+		for _, b := range p.list() {
+			go checkHealth(p, b)
+		}
+		if p.discovery != nil {
+			go p.discovery.run(p)
+		}
 	}
+	backendRegistry = newRegistry(*drainTimeout)
+	go backendRegistry.run()
+	if conf.BackendsFile != "" {
+		interval := time.Duration(conf.BackendsFileCheckSec) * time.Second
+		if interval <= 0 {
+			interval = defaultFileCheckInterval
+		}
+		go newFileDiscovery(conf.BackendsFile, interval, pools).run()
+	}
+
+	var handler http.Handler = http.HandlerFunc(handleRequest)
+	if *compress {
+		handler = newCompressor(*compressMinSize, *compressTypes).wrap(handler)
+	}
+	accessLog, err := newAccessLogger()
+	if err != nil {
+		log.Fatalf("Error opening access log: %s", err)
+	}
+	if accessLog != nil {
+		handler = accessLog.wrap(handler)
+	}
+	if tracer.Exporter, err = tracing.NewExporter(*spansFile, *otlpEndpoint, tracer.Service); err != nil {
+		log.Fatalf("Error creating span exporter: %s", err)
+	}
+	handler = tracer.Middleware(handler)
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(handleRequest))
+	var frontend httptools.Server
+	if *acceptProxyProtocol {
+		frontend = httptools.CreateServerWithListener(*port, handler, acceptProxy)
+	} else {
+		frontend = httptools.CreateServer(*port, handler)
+	}
+	admin := httptools.CreateServer(*adminPort, adminHandler())
 
 	log.Println("Starting load balancer...NYA!")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
 	frontend.Start()
+	admin.Start()
+	if *socket != "" {
+		var wrap func(net.Listener) net.Listener
+		if *acceptProxyProtocol {
+			wrap = acceptProxy
+		}
+		httptools.CreateUnixServer(*socket, handler, wrap).Start()
+	}
+	signal.OnReload(func() {
+		if err := reloadACL(); err != nil {
+			log.Printf("Failed to reload access lists: %s", err)
+		} else {
+			log.Println("Access lists reloaded")
+		}
+	})
+	for _, proxy := range tcpProxies {
+		proxy.Start()
+	}
 	signal.WaitForTerminationSignal()
 }
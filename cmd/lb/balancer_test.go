@@ -3,6 +3,10 @@ package main
 import (
 	"testing"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 )
 
 var (
@@ -32,4 +36,20 @@ func TestBalancer(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+func TestWriteResponseRequestID(t *testing.T) {
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("ok")),
+		Request:    httptest.NewRequest("GET", "/", nil),
+	}
+	resp.Header.Set("X-Request-ID", "abc")
+	rw := httptest.NewRecorder()
+	rw.Header().Set("X-Request-ID", "abc")
+	writeResponse("server1:8080", rw, resp)
+	if ids := rw.Header().Values("X-Request-ID"); len(ids) != 1 {
+		t.Errorf("Expected one request ID, got %v", ids)
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
+)
+
+const (
+	cacheHit         = "hit"
+	cacheMiss        = "miss"
+	cacheStale       = "stale"
+	cacheRevalidated = "revalidated"
+	cacheBypass      = "bypass"
+)
+
+var cache *responseCache
+
+func initCaching() {
+	cache = nil
+	if *cacheSizeMB > 0 {
+		cache = newResponseCache(*cacheSizeMB<<20, *cacheMaxStale)
+	}
+}
+
+type cacheEntry struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	backend  string
+	stored   time.Time
+	freshFor time.Duration
+	// mustRevalidate forbids serving the entry stale when backends are down.
+	mustRevalidate bool
+	elem           *list.Element
+}
+
+func (e *cacheEntry) size() int64 {
+	size := int64(len(e.key) + len(e.body))
+	for name, values := range e.header {
+		for _, value := range values {
+			size += int64(len(name) + len(value))
+		}
+	}
+	return size
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return now.Sub(e.stored)
+}
+
+func (e *cacheEntry) fresh(now time.Time) bool {
+	return e.age(now) < e.freshFor
+}
+
+// fill is an upstream request for a missing key that concurrent requests for
+// the same key wait for instead of sending their own.
+type fill struct {
+	done chan struct{}
+}
+
+// responseCache is a shared HTTP cache of GET responses with LRU eviction
+// once the stored responses take more than maxSize bytes. Responses that vary
+// by request headers are stored per combination of the Vary header values.
+type responseCache struct {
+	maxSize  int64
+	maxStale time.Duration
+
+	mu       sync.Mutex
+	size     int64
+	lru      *list.List
+	entries  map[string]*cacheEntry
+	vary     map[string][]string
+	inflight map[string]*fill
+}
+
+func newResponseCache(maxSize int64, maxStale time.Duration) *responseCache {
+	return &responseCache{
+		maxSize:  maxSize,
+		maxStale: maxStale,
+		lru:      list.New(),
+		entries:  map[string]*cacheEntry{},
+		vary:     map[string][]string{},
+		inflight: map[string]*fill{},
+	}
+}
+
+// cacheKey keys responses by the request URI and by what decides which
+// backends answer it: the pool that serves the traffic and the requested
+// backend tags.
+func cacheKey(p *pool, r *http.Request) string {
+	target, _ := p.serving()
+	var tags []string
+	for name, value := range requestTags(r) {
+		tags = append(tags, name+"="+value)
+	}
+	sort.Strings(tags)
+	return r.URL.RequestURI() + "\x00" + target.name + "\x00" + strings.Join(tags, ",")
+}
+
+// variantKey extends the primary key with the request values of the headers
+// the cached response varies by.
+func variantKey(key string, names []string, r *http.Request) string {
+	if len(names) == 0 {
+		return key
+	}
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range names {
+		b.WriteString("\x00")
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+	}
+	return b.String()
+}
+
+func (c *responseCache) lookupLocked(key string, r *http.Request) *cacheEntry {
+	e, ok := c.entries[variantKey(key, c.vary[key], r)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+func (c *responseCache) lookup(key string, r *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lookupLocked(key, r)
+}
+
+// begin returns the cached entry for r and, when r has to go upstream,
+// whether it is the one request to do so. Other requests for the key get
+// the fill to wait for.
+func (c *responseCache) begin(key string, r *http.Request) (*cacheEntry, *fill, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.lookupLocked(key, r)
+	if e != nil && e.fresh(time.Now()) {
+		return e, nil, false
+	}
+	if f, ok := c.inflight[key]; ok {
+		return e, f, false
+	}
+	f := &fill{done: make(chan struct{})}
+	c.inflight[key] = f
+	return e, f, true
+}
+
+func (c *responseCache) finish(key string, f *fill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	close(f.done)
+}
+
+func (c *responseCache) store(key string, r *http.Request, e *cacheEntry, varyBy []string) {
+	e.key = variantKey(key, varyBy, r)
+	size := e.size()
+	if size > c.maxSize/8 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !sameHeaders(c.vary[key], varyBy) {
+		// The variants stored so far were keyed by other headers.
+		c.removeLocked(func(k string) bool { return k == key || strings.HasPrefix(k, key+"\x00") })
+		c.vary[key] = varyBy
+	}
+	if old, ok := c.entries[e.key]; ok {
+		c.unlinkLocked(old)
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.key] = e
+	c.size += size
+	for c.size > c.maxSize {
+		c.unlinkLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+}
+
+// refresh stores a fresh copy of an entry after a backend confirmed it with
+// 304. Entries are never changed in place as they are served without a lock.
+func (c *responseCache) refresh(key string, r *http.Request, e *cacheEntry, h http.Header) *cacheEntry {
+	header := e.header.Clone()
+	for _, name := range []string{"Cache-Control", "Expires", "Date", "ETag", "Last-Modified"} {
+		if value := h.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	fresh, mustRevalidate, _ := freshness(header)
+	updated := &cacheEntry{
+		status:         e.status,
+		header:         header,
+		body:           e.body,
+		backend:        e.backend,
+		stored:         time.Now(),
+		freshFor:       fresh,
+		mustRevalidate: mustRevalidate,
+	}
+	c.mu.Lock()
+	varyBy := c.vary[key]
+	c.mu.Unlock()
+	c.store(key, r, updated, varyBy)
+	return updated
+}
+
+func (c *responseCache) unlinkLocked(e *cacheEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.key)
+	c.size -= e.size()
+}
+
+func (c *responseCache) removeLocked(match func(string) bool) int {
+	removed := 0
+	for key, e := range c.entries {
+		if match(key) {
+			c.unlinkLocked(e)
+			removed++
+		}
+	}
+	return removed
+}
+
+// purge removes the entries of the key, or of all keys starting with prefix,
+// and returns how many were removed.
+func (c *responseCache) purge(key, prefix string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.removeLocked(func(k string) bool {
+		primary := strings.SplitN(k, "\x00", 2)[0]
+		if key != "" {
+			return primary == key
+		}
+		return strings.HasPrefix(primary, prefix)
+	})
+}
+
+func sameHeaders(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func parseCacheControl(h http.Header) map[string]string {
+	directives := map[string]string{}
+	for _, value := range h.Values("Cache-Control") {
+		for _, part := range strings.Split(value, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			kv := strings.SplitN(part, "=", 2)
+			name := strings.ToLower(kv[0])
+			if len(kv) == 2 {
+				directives[name] = strings.Trim(kv[1], `"`)
+			} else {
+				directives[name] = ""
+			}
+		}
+	}
+	return directives
+}
+
+// freshness returns how long a response stays fresh after it was received
+// and whether it may be stored at all.
+func freshness(h http.Header) (fresh time.Duration, mustRevalidate bool, storable bool) {
+	cc := parseCacheControl(h)
+	if _, ok := cc["no-store"]; ok {
+		return 0, false, false
+	}
+	if _, ok := cc["private"]; ok {
+		return 0, false, false
+	}
+	_, mustRevalidate = cc["must-revalidate"]
+	if _, ok := cc["proxy-revalidate"]; ok {
+		mustRevalidate = true
+	}
+	var age time.Duration
+	if seconds, err := strconv.Atoi(h.Get("Age")); err == nil {
+		age = time.Duration(seconds) * time.Second
+	}
+	_, noCache := cc["no-cache"]
+	switch {
+	case noCache:
+	case cc["s-maxage"] != "":
+		if seconds, err := strconv.Atoi(cc["s-maxage"]); err == nil {
+			fresh = time.Duration(seconds)*time.Second - age
+		}
+		mustRevalidate = true
+	case cc["max-age"] != "":
+		if seconds, err := strconv.Atoi(cc["max-age"]); err == nil {
+			fresh = time.Duration(seconds)*time.Second - age
+		}
+	case h.Get("Expires") != "":
+		expires, err := http.ParseTime(h.Get("Expires"))
+		if err != nil {
+			break
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		fresh = expires.Sub(date) - age
+	}
+	validator := h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+	return fresh, mustRevalidate, fresh > 0 || validator
+}
+
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// newEntry turns a captured response into a cache entry and returns the
+// headers it varies by, or nil if the response can't be stored.
+func newEntry(r *http.Request, w *captureWriter) (*cacheEntry, []string) {
+	if !cacheableStatus(w.status) {
+		return nil, nil
+	}
+	fresh, mustRevalidate, storable := freshness(w.header)
+	if !storable {
+		return nil, nil
+	}
+	cc := parseCacheControl(w.header)
+	if authorized(r) {
+		// Shared caches only keep authorized responses marked as such.
+		_, public := cc["public"]
+		if !public && cc["s-maxage"] == "" && !mustRevalidate {
+			return nil, nil
+		}
+	}
+	var varyBy []string
+	for _, value := range w.header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "*" {
+				return nil, nil
+			}
+			if name != "" {
+				varyBy = append(varyBy, name)
+			}
+		}
+	}
+	header := w.header.Clone()
+	header.Del("Set-Cookie")
+	// Per-request headers are set again for every response.
+	header.Del(tracing.RequestIDHeader)
+	header.Del("Server-Timing")
+	for name := range header {
+		if strings.HasPrefix(name, "Lb-") {
+			header.Del(name)
+		}
+	}
+	return &cacheEntry{
+		status:         w.status,
+		header:         header,
+		body:           append([]byte(nil), w.body.Bytes()...),
+		backend:        w.backend,
+		stored:         time.Now(),
+		freshFor:       fresh,
+		mustRevalidate: mustRevalidate,
+	}, varyBy
+}
+
+// authorized tells whether r carries credentials, either in Authorization or
+// in the API key header of its route.
+func authorized(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Header.Get(defaultAPIKeyHeader) != "" {
+		return true
+	}
+	rt := matchRoute(routes, r.URL.Path)
+	return rt != nil && rt.auth != nil && r.Header.Get(rt.auth.apiKeyHeader) != ""
+}
+
+// captureWriter buffers a response so the cache can decide what to send to
+// the client. Once the body outgrows limit it is written through instead.
+// It holds the backend headers before the response header rules of the
+// route, which are applied to every response the cache writes.
+type captureWriter struct {
+	rw      http.ResponseWriter
+	r       *http.Request
+	header  http.Header
+	status  int
+	body    bytes.Buffer
+	limit   int64
+	backend string
+
+	passthrough bool
+}
+
+func (w *captureWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.passthrough {
+		return w.rw.Write(b)
+	}
+	if int64(w.body.Len()+len(b)) > w.limit {
+		w.flush()
+		w.passthrough = true
+		return w.rw.Write(b)
+	}
+	return w.body.Write(b)
+}
+
+func (w *captureWriter) flush() {
+	copyHeader(w.rw.Header(), w.header)
+	if w.backend != "" {
+		applyResponseRules(w.rw.Header(), w.r, w.backend)
+	}
+	w.rw.WriteHeader(w.status)
+	_, _ = w.rw.Write(w.body.Bytes())
+	w.body.Reset()
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = append([]string(nil), values...)
+	}
+}
+
+func writeCached(rw http.ResponseWriter, r *http.Request, e *cacheEntry, result string) {
+	incCounter("lb_cache_requests_total", "result", result)
+	copyHeader(rw.Header(), e.header)
+	applyResponseRules(rw.Header(), r, e.backend)
+	rw.Header().Set("Age", strconv.Itoa(int(e.age(time.Now()).Seconds())))
+	rw.Header().Set("X-Cache", strings.ToUpper(result))
+	if result == cacheStale {
+		rw.Header().Add("Warning", `111 - "Revalidation Failed"`)
+	}
+	if etag := e.header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.WriteHeader(e.status)
+	_, _ = rw.Write(e.body)
+}
+
+// serveCached serves GET requests from the cache when possible and stores
+// cacheable responses of p. A stale entry is revalidated with the backend
+// and served as is when no backend can answer.
+func serveCached(p *pool, rw http.ResponseWriter, r *http.Request) {
+	c := cache
+	if c == nil || r.Method != http.MethodGet {
+		serve(p, rw, r)
+		return
+	}
+	cc := parseCacheControl(r.Header)
+	if _, ok := cc["no-store"]; ok {
+		incCounter("lb_cache_requests_total", "result", cacheBypass)
+		serve(p, rw, r)
+		return
+	}
+	_, noCache := cc["no-cache"]
+
+	key := cacheKey(p, r)
+	e, f, leader := c.begin(key, r)
+	if e != nil && f == nil && !noCache {
+		writeCached(rw, r, e, cacheHit)
+		return
+	}
+	if f != nil && !leader {
+		select {
+		case <-f.done:
+		case <-r.Context().Done():
+			return
+		}
+		// Without a fresh copy from the fill the request goes upstream
+		// itself, still falling back to a stale copy.
+		if e = c.lookup(key, r); e != nil && e.fresh(time.Now()) && !noCache {
+			writeCached(rw, r, e, cacheHit)
+			return
+		}
+	}
+	if leader {
+		defer c.finish(key, f)
+	}
+
+	upstream := r
+	if e != nil {
+		upstream = r.Clone(r.Context())
+		upstream.Header.Del("If-Modified-Since")
+		upstream.Header.Del("If-None-Match")
+		if etag := e.header.Get("ETag"); etag != "" {
+			upstream.Header.Set("If-None-Match", etag)
+		}
+		if modified := e.header.Get("Last-Modified"); modified != "" {
+			upstream.Header.Set("If-Modified-Since", modified)
+		}
+	}
+	w := &captureWriter{rw: rw, r: r, header: http.Header{}, limit: c.maxSize / 8}
+	serve(p, w, upstream)
+	if w.passthrough {
+		incCounter("lb_cache_requests_total", "result", cacheMiss)
+		return
+	}
+
+	if e != nil {
+		switch {
+		case w.status == http.StatusNotModified:
+			writeCached(rw, r, c.refresh(key, r, e, w.header), cacheRevalidated)
+			return
+		case w.status >= http.StatusInternalServerError && !e.mustRevalidate && e.age(time.Now()) < e.freshFor+c.maxStale:
+			writeCached(rw, r, e, cacheStale)
+			return
+		}
+	}
+	incCounter("lb_cache_requests_total", "result", cacheMiss)
+	if entry, varyBy := newEntry(r, w); entry != nil {
+		c.store(key, r, entry, varyBy)
+	}
+	w.header.Set("X-Cache", strings.ToUpper(cacheMiss))
+	w.flush()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cachedPool(t *testing.T, handler http.HandlerFunc) (*pool, *httptest.Server) {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return &pool{
+		name:       "cached",
+		backends:   []*backend{newBackend(strings.TrimPrefix(server.URL, "http://"))},
+		minHealthy: 1,
+		active:     "cached",
+	}, server
+}
+
+func getCached(p *pool, path string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rw := httptest.NewRecorder()
+	serveCached(p, rw, r)
+	return rw
+}
+
+func TestCacheRevalidateAndStale(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	var requests int32
+	p, server := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			rw.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = rw.Write([]byte("data"))
+	})
+
+	for i, expected := range []string{"MISS", "HIT"} {
+		rw := getCached(p, "/api/v1/some-data?key=a")
+		if rw.Header().Get("X-Cache") != expected || rw.Body.String() != "data" {
+			t.Errorf("Request %d: unexpected response %s %q", i, rw.Header().Get("X-Cache"), rw.Body.String())
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Cached response was requested %d times", requests)
+	}
+
+	expire := func() {
+		r := httptest.NewRequest("GET", "/api/v1/some-data?key=a", nil)
+		e := cache.lookup(cacheKey(p, r), r)
+		e.stored = e.stored.Add(-2 * time.Minute)
+	}
+	expire()
+	rw := getCached(p, "/api/v1/some-data?key=a")
+	if rw.Header().Get("X-Cache") != "REVALIDATED" || rw.Body.String() != "data" || requests != 2 {
+		t.Errorf("Expired entry was not revalidated: %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	if rw := getCached(p, "/api/v1/some-data?key=a", "If-None-Match", `"v1"`); rw.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for a matching client ETag, got %d", rw.Code)
+	}
+
+	expire()
+	server.Close()
+	rw = getCached(p, "/api/v1/some-data?key=a")
+	if rw.Code != http.StatusOK || rw.Header().Get("X-Cache") != "STALE" || rw.Body.String() != "data" {
+		t.Errorf("Stale entry was not served with backends down: %d %s", rw.Code, rw.Header().Get("X-Cache"))
+	}
+}
+
+func TestCacheVaryAndNoStore(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	p, _ := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("key") == "private" {
+			rw.Header().Set("Cache-Control", "no-store")
+		} else {
+			rw.Header().Set("Cache-Control", "max-age=60")
+			rw.Header().Set("Vary", "Accept-Language")
+		}
+		_, _ = rw.Write([]byte(r.Header.Get("Accept-Language")))
+	})
+
+	getCached(p, "/data?key=a", "Accept-Language", "en")
+	if rw := getCached(p, "/data?key=a", "Accept-Language", "uk"); rw.Body.String() != "uk" || rw.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Variant for another language served: %q", rw.Body.String())
+	}
+	if rw := getCached(p, "/data?key=a", "Accept-Language", "en"); rw.Body.String() != "en" || rw.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("Variant was not cached: %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	getCached(p, "/data?key=private")
+	if rw := getCached(p, "/data?key=private"); rw.Header().Get("X-Cache") == "HIT" {
+		t.Errorf("no-store response was cached")
+	}
+
+	if n := cache.purge("", "/data?key=a"); n != 2 {
+		t.Errorf("Expected 2 purged variants, got %d", n)
+	}
+	if rw := getCached(p, "/data?key=a", "Accept-Language", "en"); rw.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Purged entry was served")
+	}
+}
+
+func TestCacheCollapsing(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	var requests int32
+	p, _ := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(50 * time.Millisecond)
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("data"))
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rw := getCached(p, "/data"); rw.Body.String() != "data" {
+				t.Errorf("Unexpected body %q", rw.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if requests != 1 {
+		t.Errorf("Concurrent misses sent %d upstream requests", requests)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newResponseCache(1000, time.Hour)
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest("GET", fmt.Sprintf("/data?key=%d", i), nil)
+		c.store(r.URL.RequestURI(), r, &cacheEntry{status: http.StatusOK, header: http.Header{}, body: make([]byte, 100), stored: time.Now()}, nil)
+		if i == 2 {
+			c.lookup("/data?key=0", httptest.NewRequest("GET", "/data?key=0", nil))
+		}
+	}
+	if c.size > 1000 {
+		t.Errorf("Cache is over its size limit: %d", c.size)
+	}
+	if c.lookup("/data?key=0", httptest.NewRequest("GET", "/data?key=0", nil)) == nil {
+		t.Errorf("Recently used entry was evicted")
+	}
+	if c.lookup("/data?key=1", httptest.NewRequest("GET", "/data?key=1", nil)) != nil {
+		t.Errorf("Least recently used entry was kept")
+	}
+}
+
+func TestCacheKeyedByPoolAndTags(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	defer func(header string) { *tagHeader = header }(*tagHeader)
+	*tagHeader = "X-Backend-Tags"
+	respond := func(body string) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Cache-Control", "max-age=60")
+			_, _ = rw.Write([]byte(body + r.Header.Get("X-Backend-Tags")))
+		}
+	}
+	stable, _ := cachedPool(t, respond("stable"))
+	canary, _ := cachedPool(t, respond("canary"))
+	canary.name, canary.active = "canary", "canary"
+
+	getCached(stable, "/x")
+	if rw := getCached(canary, "/x"); rw.Header().Get("X-Cache") != "MISS" || rw.Body.String() != "canary" {
+		t.Errorf("Canary request got %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+	if rw := getCached(stable, "/x", "X-Backend-Tags", "version=v2"); rw.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("Tagged request got the untagged response %q", rw.Body.String())
+	}
+	if rw := getCached(stable, "/x"); rw.Header().Get("X-Cache") != "HIT" || rw.Body.String() != "stable" {
+		t.Errorf("Stable request got %s %q", rw.Header().Get("X-Cache"), rw.Body.String())
+	}
+}
+
+func TestCacheKeepsRequestHeaders(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	p, _ := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		rw.Header().Set("X-Request-ID", r.Header.Get("X-Request-ID"))
+		rw.Header().Set("Lb-From", "backend")
+		_, _ = rw.Write([]byte("data"))
+	})
+
+	getCached(p, "/x", "X-Request-ID", "first")
+	r := httptest.NewRequest("GET", "/x", nil)
+	rw := httptest.NewRecorder()
+	rw.Header().Set("X-Request-ID", "second")
+	serveCached(p, rw, r)
+	if rw.Header().Get("X-Cache") != "HIT" || rw.Header().Get("X-Request-ID") != "second" || rw.Header().Get("Lb-From") != "" {
+		t.Errorf("Cached per-request headers were replayed: %v", rw.Header())
+	}
+
+	getCached(p, "/keyed", "X-API-Key", "secret")
+	if rw := getCached(p, "/keyed", "X-API-Key", "secret"); rw.Header().Get("X-Cache") == "HIT" {
+		t.Errorf("Response to an API key was shared")
+	}
+}
+
+func TestCacheStaleForCollapsedRequests(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	var failing int32
+	p, _ := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			time.Sleep(50 * time.Millisecond)
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("data"))
+	})
+	getCached(p, "/data")
+	r := httptest.NewRequest("GET", "/data", nil)
+	e := cache.lookup(cacheKey(p, r), r)
+	e.stored = e.stored.Add(-2 * time.Minute)
+	atomic.StoreInt32(&failing, 1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rw := getCached(p, "/data"); rw.Code != http.StatusOK || rw.Header().Get("X-Cache") != "STALE" {
+				t.Errorf("Collapsed request got %d %s", rw.Code, rw.Header().Get("X-Cache"))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCacheAppliesHeaderRulesPerResponse(t *testing.T) {
+	cache = newResponseCache(1<<20, time.Hour)
+	defer func() { cache = nil }()
+	defer func(saved []*route) { routes = saved }(routes)
+	rules, err := parseHeaderRules([]headerRuleConfig{{Action: "set", Name: "X-Client", Value: "{{.ClientIP}}"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes = []*route{{prefix: "/", responseHeaders: rules}}
+	p, _ := cachedPool(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		_, _ = rw.Write([]byte("data"))
+	})
+
+	for i, client := range []string{"10.0.0.1", "10.0.0.2"} {
+		r := httptest.NewRequest("GET", "/x", nil)
+		r.RemoteAddr = client + ":1234"
+		rw := httptest.NewRecorder()
+		serveCached(p, rw, r)
+		if rw.Header().Get("X-Client") != client {
+			t.Errorf("Request %d from %s got X-Client %q (%s)", i, client, rw.Header().Get("X-Client"), rw.Header().Get("X-Cache"))
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// runCheck validates the configuration the way the balancer does on startup
+// without serving traffic, prints the resolved routing table and returns the
+// exit code. With probe every backend gets one health check.
+func runCheck(path string, probe bool, out io.Writer) int {
+	fail := func(err error) int {
+		fmt.Fprintf(out, "Invalid config: %s\n", err)
+		return 1
+	}
+	conf, err := loadConfig(path)
+	if err != nil {
+		return fail(err)
+	}
+	checkPools, err := buildPools(conf)
+	if err != nil {
+		return fail(err)
+	}
+	checkRoutes, err := buildRoutes(conf, checkPools)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err := parseCIDRs(conf.TrustedProxies); err != nil {
+		return fail(fmt.Errorf("trusted proxies: %w", err))
+	}
+	proxies, err := buildTCPProxies(conf, checkPools)
+	if err != nil {
+		return fail(err)
+	}
+	if conf.BackendsFile != "" {
+		if err := checkBackendsFile(conf.BackendsFile, checkPools); err != nil {
+			return fail(fmt.Errorf("backends file: %w", err))
+		}
+	}
+
+	printRoutingTable(out, checkRoutes, checkPools, proxies)
+	if probe && !probeBackends(out, checkPools) {
+		return 1
+	}
+	fmt.Fprintln(out, "Config OK")
+	return 0
+}
+
+func checkBackendsFile(path string, pools []*pool) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	groups, err := parseBackendsFile(data)
+	if err != nil {
+		return err
+	}
+	for name := range groups {
+		if poolByName(pools, name) == nil {
+			return fmt.Errorf("unknown pool %q", name)
+		}
+	}
+	return nil
+}
+
+func printRoutingTable(out io.Writer, routes []*route, pools []*pool, proxies []*tcpProxy) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROUTE\tPOOLS\tOPTIONS")
+	for _, rt := range routes {
+		var splits []string
+		for _, s := range rt.splits {
+			splits = append(splits, fmt.Sprintf("%s=%d", s.pool.name, s.weight))
+		}
+		var options []string
+		if rt.stickyKind != "" {
+			options = append(options, "sticky="+strings.TrimSuffix(rt.stickyKind+":"+rt.stickyName, ":"))
+		}
+		if rt.mirror != nil {
+			options = append(options, fmt.Sprintf("mirror=%s:%g%%", rt.mirror.pool.name, rt.mirror.percent))
+		}
+		if rt.acl != nil {
+			options = append(options, "acl")
+		}
+		if rt.auth != nil {
+			options = append(options, "auth")
+		}
+		if rt.maintenance.isEnabled() {
+			options = append(options, "maintenance")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", rt.prefix, strings.Join(splits, ","), strings.Join(options, ","))
+	}
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "POOL\tSTRATEGY\tHEALTH\tBACKENDS\tBACKUPS")
+	for _, p := range pools {
+		var backends []string
+		for _, b := range p.list() {
+			backends = append(backends, describeBackend(b))
+		}
+		if p.discovery != nil {
+			backends = append(backends, "discovery:"+p.discovery.name())
+		}
+		var backups []string
+		for _, backup := range p.backups {
+			backups = append(backups, backup.name)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.name, p.strategy, p.healthCheck, strings.Join(backends, ","), strings.Join(backups, ","))
+	}
+
+	if len(proxies) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "TCP PORT\tPOOL")
+		for _, proxy := range proxies {
+			fmt.Fprintf(w, "%d\t%s\n", proxy.port, proxy.pool.name)
+		}
+	}
+	w.Flush()
+}
+
+func describeBackend(b *backend) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	description := b.addr
+	if b.share != 1 {
+		description += fmt.Sprintf("*%d", b.share)
+	}
+	if len(b.tags) > 0 {
+		var tags []string
+		for key, value := range b.tags {
+			tags = append(tags, key+"="+value)
+		}
+		sort.Strings(tags)
+		description += "[" + strings.Join(tags, " ") + "]"
+	}
+	return description
+}
+
+// probeBackends runs one health check against every backend and reports
+// whether all of them passed.
+func probeBackends(out io.Writer, pools []*pool) bool {
+	ok := true
+	for _, p := range pools {
+		for _, b := range p.list() {
+			var healthy bool
+			if p.healthCheck == healthCheckTCP {
+				healthy = tcpHealth(b.addr)
+			} else {
+				healthy, _ = health(b.addr)
+			}
+			status := "ok"
+			if !healthy {
+				status, ok = "FAILED", false
+			}
+			fmt.Fprintf(out, "probe %s %s: %s\n", p.name, b.addr, status)
+		}
+	}
+	return ok
+}
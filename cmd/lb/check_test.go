@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	addr := strings.TrimPrefix(backend.URL, "http://")
+
+	valid := fmt.Sprintf(`{
+		"pools": [
+			{"name": "stable", "servers": [%q]},
+			{"name": "canary", "backends": [{"address": %q, "weight": 2, "tags": {"zone": "a"}}], "backups": ["stable"]}
+		],
+		"routes": [
+			{"prefix": "/api", "split": [{"pool": "stable", "weight": 9}, {"pool": "canary", "weight": 1}], "sticky": "header:X-User",
+			 "requestHeaders": [{"action": "replace", "name": "X-Path", "pattern": "^/api", "value": "/v1"}]}
+		]
+	}`, addr, addr)
+	var out bytes.Buffer
+	if code := runCheck(writeTestFile(t, "lb.json", valid), true, &out); code != 0 {
+		t.Fatalf("Valid config failed the check:\n%s", out.String())
+	}
+	for _, expected := range []string{"/api", "stable=9,canary=1", "sticky=header:X-User", addr + "*2[zone=a]", "probe canary " + addr + ": ok", "Config OK"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Output lacks %q:\n%s", expected, out.String())
+		}
+	}
+
+	for name, conf := range map[string]string{
+		"address":   `{"pools": [{"name": "servers", "servers": ["server1"]}]}`,
+		"duplicate": `{"pools": [{"name": "servers", "servers": ["server1:8080", "server1:8080"]}]}`,
+		"strategy":  `{"pools": [{"name": "servers", "servers": ["server1:8080"], "strategy": "random"}]}`,
+		"unknown":   `{"pools": [{"name": "servers", "servers": ["server1:8080"], "strategey": "hash"}]}`,
+		"heavy":     `{"pools": [{"name": "servers", "backends": [{"address": "server1:8080", "weight": 1000000}]}]}`,
+		"regex":     `{"pools": [{"name": "servers", "servers": ["server1:8080"]}], "routes": [{"prefix": "/", "pool": "servers", "requestHeaders": [{"action": "replace", "name": "X", "pattern": "("}]}]}`,
+		"weight":    `{"pools": [{"name": "servers", "servers": ["server1:8080"]}], "routes": [{"prefix": "/", "split": [{"pool": "servers", "weight": -1}]}]}`,
+	} {
+		out.Reset()
+		if code := runCheck(writeTestFile(t, name+".json", conf), false, &out); code == 0 {
+			t.Errorf("Config with invalid %s passed the check", name)
+		}
+	}
+
+	out.Reset()
+	unreachable := `{"pools": [{"name": "servers", "servers": ["127.0.0.1:1"]}]}`
+	if code := runCheck(writeTestFile(t, "down.json", unreachable), true, &out); code == 0 || !strings.Contains(out.String(), "FAILED") {
+		t.Errorf("Failed probe passed the check:\n%s", out.String())
+	}
+}
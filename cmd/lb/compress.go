@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressor encodes responses with gzip or deflate when the client accepts
+// it, the content type is in the allowlist and the body is at least minSize
+// bytes.
+type compressor struct {
+	minSize int
+	types   map[string]bool
+}
+
+func newCompressor(minSize int, types string) *compressor {
+	c := &compressor{minSize: minSize, types: map[string]bool{}}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			c.types[strings.ToLower(t)] = true
+		}
+	}
+	return c
+}
+
+// acceptedEncoding picks gzip or deflate from Accept-Encoding, preferring
+// gzip and skipping codings with q=0.
+func acceptedEncoding(r *http.Request) string {
+	accepted := map[string]bool{}
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(value, ",") {
+			params := strings.Split(part, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			ok := true
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64)
+					ok = err == nil && q > 0
+				}
+			}
+			accepted[coding] = ok
+		}
+	}
+	for _, coding := range []string{"gzip", "deflate"} {
+		if accepted[coding] {
+			return coding
+		}
+	}
+	return ""
+}
+
+func (c *compressor) compressible(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && c.types[mediaType]
+}
+
+func (c *compressor) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+		w := &compressWriter{ResponseWriter: rw, c: c, encoding: acceptedEncoding(r)}
+		next.ServeHTTP(w, r)
+		w.close()
+	})
+}
+
+// compressWriter holds back the start of the body until it is clear whether
+// the response should be compressed.
+type compressWriter struct {
+	http.ResponseWriter
+	c        *compressor
+	encoding string
+
+	status  int
+	buf     bytes.Buffer
+	decided bool
+	encoder io.WriteCloser
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.decided {
+		if w.encoder != nil {
+			return w.encoder.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	n, _ := w.buf.Write(b)
+	if w.buf.Len() >= w.c.minSize || !w.eligible() {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// eligible tells whether the response may be compressed judging by its
+// status and headers.
+func (w *compressWriter) eligible() bool {
+	h := w.Header()
+	switch {
+	case w.status < http.StatusOK, w.status == http.StatusNoContent,
+		w.status == http.StatusNotModified, w.status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", !w.c.compressible(h):
+		return false
+	}
+	if length, err := strconv.Atoi(h.Get("Content-Length")); err == nil && length < w.c.minSize {
+		return false
+	}
+	return true
+}
+
+// decide sends the headers and the buffered body, compressing them if the
+// response is eligible and big enough.
+func (w *compressWriter) decide(bigEnough bool) error {
+	w.decided = true
+	h := w.Header()
+	eligible := w.eligible()
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && bigEnough && w.encoding != "" {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.encoding)
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		if w.encoding == "gzip" {
+			w.encoder = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.encoder = zlib.NewWriter(w.ResponseWriter)
+		}
+		incCounter("lb_compressed_responses_total", "encoding", w.encoding)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.encoder != nil {
+		_, err = w.encoder.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// Flush marks a streaming response, which is sent as is.
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 {
+			w.status = http.StatusOK
+		}
+		w.encoding = ""
+		_ = w.decide(false)
+	}
+	if w.encoder != nil {
+		if f, ok := w.encoder.(interface{ Flush() error }); ok {
+			_ = f.Flush()
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 {
+			return
+		}
+		_ = w.decide(w.buf.Len() >= w.c.minSize)
+	}
+	if w.encoder != nil {
+		_ = w.encoder.Close()
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func compressed(handler http.HandlerFunc, acceptEncoding string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/report", nil)
+	if acceptEncoding != "" {
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	rw := httptest.NewRecorder()
+	newCompressor(100, "application/json").wrap(handler).ServeHTTP(rw, r)
+	return rw
+}
+
+func TestCompression(t *testing.T) {
+	body := strings.Repeat(`{"key":"value"},`, 100)
+	handler := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.Header().Set("Content-Length", "1600")
+		rw.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(rw, body)
+	}
+
+	for encoding, reader := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":    func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate": func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		rw := compressed(handler, encoding+", br;q=0")
+		if rw.Header().Get("Content-Encoding") != encoding || rw.Header().Get("Content-Length") != "" {
+			t.Errorf("%s: unexpected headers %v", encoding, rw.Header())
+		}
+		if rw.Header().Get("Vary") != "Accept-Encoding" || rw.Header().Get("ETag") != `W/"v1"` {
+			t.Errorf("%s: unexpected Vary or ETag %v", encoding, rw.Header())
+		}
+		decoder, err := reader(rw.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := ioutil.ReadAll(decoder); string(data) != body {
+			t.Errorf("%s: body was not restored", encoding)
+		}
+	}
+
+	rw := compressed(handler, "gzip;q=0")
+	if rw.Header().Get("Content-Encoding") != "" || rw.Body.String() != body {
+		t.Errorf("Response compressed for a client that refused gzip")
+	}
+	if rw.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Uncompressed variant lacks Vary")
+	}
+}
+
+func TestCompressionSkipped(t *testing.T) {
+	long := strings.Repeat("a", 200)
+	for name, tc := range map[string]struct {
+		handler http.HandlerFunc
+		body    string
+	}{
+		"small": {func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(rw, "{}")
+		}, "{}"},
+		"type": {func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "image/png")
+			_, _ = io.WriteString(rw, long)
+		}, long},
+		"encoded": {func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.Header().Set("Content-Encoding", "br")
+			_, _ = io.WriteString(rw, long)
+		}, long},
+		"streaming": {func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			_, _ = io.WriteString(rw, long[:10])
+			rw.(http.Flusher).Flush()
+			_, _ = io.WriteString(rw, long[10:])
+		}, long},
+	} {
+		rw := compressed(tc.handler, "gzip")
+		if rw.Header().Get("Content-Encoding") == "gzip" {
+			t.Errorf("%s: response was compressed", name)
+		}
+		if rw.Body.String() != tc.body {
+			t.Errorf("%s: unexpected body %q", name, rw.Body.String())
+		}
+	}
+}
+
+func TestCompressionSkippedForStreamedBackend(t *testing.T) {
+	release := make(chan struct{})
+	backendServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(rw, "data: "+strings.Repeat("a", 200)+"\n\n")
+		rw.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(rw, "data: done\n\n")
+	}))
+	defer backendServer.Close()
+	addr := strings.TrimPrefix(backendServer.URL, "http://")
+
+	lb := httptest.NewServer(newCompressor(100, "text/event-stream").wrap(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_ = forward(addr, rw, r)
+	})))
+	defer lb.Close()
+	defer close(release)
+	r, _ := http.NewRequest("GET", lb.URL+"/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Errorf("Streamed response was compressed")
+	}
+
+	event := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		event <- line
+	}()
+	select {
+	case line := <-event:
+		if !strings.HasPrefix(line, "data: aaa") {
+			t.Errorf("Unexpected first event %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("First event was held back until the response ended")
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"strconv"
+	"time"
+)
+
+type poolConfig struct {
+	Name    string   `json:"name"`
+	Servers []string `json:"servers"`
+	// Backups are names of pools that take the traffic when fewer than
+	// MinHealthy servers of this pool are healthy.
+	Backups    []string `json:"backups,omitempty"`
+	MinHealthy int      `json:"minHealthy,omitempty"`
+	// Strategy is "hash" of the client address (default) or
+	// "least-connections".
+	Strategy string `json:"strategy,omitempty"`
+	// HealthCheck is "http" (default) or "tcp" for pools that don't speak
+	// HTTP.
+	HealthCheck string `json:"healthCheck,omitempty"`
+	// SlowStartSec is the time over which a backend that became healthy
+	// again ramps up to its full share of traffic.
+	SlowStartSec int `json:"slowStartSec,omitempty"`
+	// Discovery replaces Servers with the addresses a DNS record resolves to.
+	Discovery *discoveryConfig `json:"discovery,omitempty"`
+	// Backends are servers with a weight and tags, e.g. {"zone": "a"}.
+	Backends []serverConfig `json:"backends,omitempty"`
+	// LocalityThreshold is the share of the pool backends in the balancer
+	// zone that has to be healthy to keep traffic in the zone.
+	LocalityThreshold float64            `json:"localityThreshold,omitempty"`
+	Maintenance       *maintenanceConfig `json:"maintenance,omitempty"`
+}
+
+// maintenanceConfig puts a route or a pool into maintenance. Clients from
+// Allow and requests with the BypassHeader set to BypassToken still pass.
+type maintenanceConfig struct {
+	Enabled       bool     `json:"enabled"`
+	Message       string   `json:"message,omitempty"`
+	RetryAfterSec int      `json:"retryAfterSec,omitempty"`
+	Allow         []string `json:"allow,omitempty"`
+	BypassHeader  string   `json:"bypassHeader,omitempty"`
+	BypassToken   string   `json:"bypassToken,omitempty"`
+}
+
+type serverConfig struct {
+	Address string            `json:"address"`
+	Weight  int               `json:"weight,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// discoveryConfig is either DNS, a "host:port" whose A/AAAA records become
+// backends, or SRV, a record name whose targets and ports become backends.
+type discoveryConfig struct {
+	DNS         string `json:"dns,omitempty"`
+	SRV         string `json:"srv,omitempty"`
+	IntervalSec int    `json:"intervalSec,omitempty"`
+}
+
+type splitConfig struct {
+	Pool   string `json:"pool"`
+	Weight int    `json:"weight"`
+}
+
+type mirrorConfig struct {
+	Pool    string  `json:"pool"`
+	Percent float64 `json:"percent"`
+}
+
+// headerRuleConfig adds, sets, removes or regex-replaces a header. Value is a
+// template with the fields of headerVars, e.g. "{{.ClientIP}}". For replace,
+// Value is the replacement of Pattern matches and can refer to groups as $1.
+type headerRuleConfig struct {
+	Action  string `json:"action"`
+	Name    string `json:"name"`
+	Value   string `json:"value,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// jwtConfig validates bearer tokens signed with HS256 (KeyFile holds the
+// secret) or RS256 (KeyFile holds a PEM public key or certificate).
+type jwtConfig struct {
+	Algorithm string   `json:"algorithm"`
+	KeyFile   string   `json:"keyFile"`
+	Issuer    string   `json:"issuer,omitempty"`
+	Audience  string   `json:"audience,omitempty"`
+	LeewaySec int      `json:"leewaySec,omitempty"`
+	Claims    []string `json:"claims,omitempty"`
+}
+
+// authConfig enables authentication on a route. APIKeysFile has "key subject"
+// lines, BasicUsersFile has "user:bcrypt-hash" lines.
+type authConfig struct {
+	Realm          string     `json:"realm,omitempty"`
+	APIKeysFile    string     `json:"apiKeysFile,omitempty"`
+	APIKeyHeader   string     `json:"apiKeyHeader,omitempty"`
+	BasicUsersFile string     `json:"basicUsersFile,omitempty"`
+	JWT            *jwtConfig `json:"jwt,omitempty"`
+}
+
+type routeConfig struct {
+	Prefix string `json:"prefix"`
+	// Pool receives all traffic of the route unless Split is set.
+	Pool  string        `json:"pool,omitempty"`
+	Split []splitConfig `json:"split,omitempty"`
+	// Sticky selects the client key that pins a client to one side of the
+	// split: "ip", "header:<name>" or "cookie:<name>". Empty means random.
+	Sticky string `json:"sticky,omitempty"`
+	// OverrideHeader and OverrideCookie name the pool to use for testers.
+	OverrideHeader string `json:"overrideHeader,omitempty"`
+	OverrideCookie string `json:"overrideCookie,omitempty"`
+	// Mirror copies a percentage of requests to a shadow pool.
+	Mirror *mirrorConfig `json:"mirror,omitempty"`
+	// ErrorPages maps a status code such as "503" to an HTML template file
+	// rendered for browsers when the balancer fails the request.
+	ErrorPages map[string]string `json:"errorPages,omitempty"`
+	// RequestHeaders are applied before forwarding, ResponseHeaders before
+	// returning the backend response.
+	RequestHeaders  []headerRuleConfig `json:"requestHeaders,omitempty"`
+	ResponseHeaders []headerRuleConfig `json:"responseHeaders,omitempty"`
+	// Allow and Deny are client IPs or CIDR ranges. Deny wins, and when Allow
+	// is set only matching clients pass.
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Auth requires clients to authenticate before forwarding.
+	Auth        *authConfig        `json:"auth,omitempty"`
+	Maintenance *maintenanceConfig `json:"maintenance,omitempty"`
+}
+
+// tcpListenerConfig describes a layer-4 frontend that splices connections to
+// a pool.
+type tcpListenerConfig struct {
+	Port           int    `json:"port"`
+	Pool           string `json:"pool"`
+	IdleTimeoutSec int    `json:"idleTimeoutSec,omitempty"`
+	MaxConns       int    `json:"maxConns,omitempty"`
+	// AcceptProxy requires PROXY protocol headers from clients, SendProxy
+	// is the PROXY protocol version (1 or 2) sent to backends.
+	AcceptProxy bool `json:"acceptProxy,omitempty"`
+	SendProxy   int  `json:"sendProxy,omitempty"`
+}
+
+// config is the balancer configuration read from the -config file. Requests
+// are matched to routes by the longest path prefix. Without routes all
+// traffic goes to the first pool.
+type config struct {
+	Pools        []poolConfig        `json:"pools"`
+	Routes       []routeConfig       `json:"routes,omitempty"`
+	TCPListeners []tcpListenerConfig `json:"tcpListeners,omitempty"`
+	// TrustedProxies are CIDR ranges whose X-Forwarded-For is trusted.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// BackendsFile lists backends by pool and is watched for changes.
+	BackendsFile         string `json:"backendsFile,omitempty"`
+	BackendsFileCheckSec int    `json:"backendsFileCheckSec,omitempty"`
+}
+
+var defaultConfig = config{
+	Pools: []poolConfig{
+		{
+			Name: "servers",
+			Servers: []string{
+				"server1:8080",
+				"server2:8080",
+				"server3:8080",
+			},
+		},
+	},
+}
+
+func loadConfig(path string) (*config, error) {
+	if path == "" {
+		c := defaultConfig
+		return &c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c config
+	// Misspelled keys would otherwise be ignored silently.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &c, nil
+}
+
+func buildPools(c *config) ([]*pool, error) {
+	if len(c.Pools) == 0 {
+		return nil, fmt.Errorf("no pools configured")
+	}
+	byName := map[string]*pool{}
+	var pools []*pool
+	for _, pc := range c.Pools {
+		if _, exists := byName[pc.Name]; exists {
+			return nil, fmt.Errorf("duplicate pool %q", pc.Name)
+		}
+		p := &pool{
+			name:        pc.Name,
+			minHealthy:  pc.MinHealthy,
+			strategy:    pc.Strategy,
+			healthCheck: pc.HealthCheck,
+			slowStart:   time.Duration(pc.SlowStartSec) * time.Second,
+			active:      pc.Name,
+		}
+		if pc.SlowStartSec < 0 {
+			return nil, fmt.Errorf("pool %q: negative slow start", pc.Name)
+		}
+		if p.minHealthy < 1 {
+			p.minHealthy = 1
+		}
+		switch p.strategy {
+		case "":
+			p.strategy = strategyHash
+		case strategyHash, strategyLeastConnections:
+		default:
+			return nil, fmt.Errorf("pool %q: unknown strategy %q", pc.Name, pc.Strategy)
+		}
+		switch p.healthCheck {
+		case "":
+			p.healthCheck = healthCheckHTTP
+		case healthCheckHTTP, healthCheckTCP:
+		default:
+			return nil, fmt.Errorf("pool %q: unknown health check %q", pc.Name, pc.HealthCheck)
+		}
+		var servers []serverConfig
+		for _, addr := range pc.Servers {
+			servers = append(servers, serverConfig{Address: addr})
+		}
+		servers = append(servers, pc.Backends...)
+		seen := map[string]bool{}
+		for _, sc := range servers {
+			if err := validBackendAddr(sc.Address); err != nil {
+				return nil, fmt.Errorf("pool %q: invalid backend address %q: %w", pc.Name, sc.Address, err)
+			}
+			if seen[sc.Address] {
+				return nil, fmt.Errorf("pool %q: duplicate backend %q", pc.Name, sc.Address)
+			}
+			seen[sc.Address] = true
+			if sc.Weight < 0 || sc.Weight > maxBackendWeight {
+				return nil, fmt.Errorf("pool %q: weight for %q is not between 0 and %d", pc.Name, sc.Address, maxBackendWeight)
+			}
+			b := newBackend(sc.Address)
+			b.configure(sc.Weight, sc.Tags)
+			p.backends = append(p.backends, b)
+		}
+		switch {
+		case pc.LocalityThreshold < 0 || pc.LocalityThreshold > 1:
+			return nil, fmt.Errorf("pool %q: locality threshold must be between 0 and 1", pc.Name)
+		case pc.LocalityThreshold == 0:
+			p.localityThreshold = defaultLocalityThreshold
+		default:
+			p.localityThreshold = pc.LocalityThreshold
+		}
+		var err error
+		if p.maintenance, err = newMaintenance(pc.Maintenance); err != nil {
+			return nil, fmt.Errorf("pool %q: maintenance: %w", pc.Name, err)
+		}
+		if pc.Discovery != nil {
+			if p.discovery, err = newDNSDiscovery(pc.Discovery); err != nil {
+				return nil, fmt.Errorf("pool %q: discovery: %w", pc.Name, err)
+			}
+		}
+		byName[pc.Name] = p
+		pools = append(pools, p)
+	}
+	for i, pc := range c.Pools {
+		for _, name := range pc.Backups {
+			backup, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("pool %q: unknown backup pool %q", pc.Name, name)
+			}
+			if backup == pools[i] {
+				return nil, fmt.Errorf("pool %q is its own backup", pc.Name)
+			}
+			pools[i].backups = append(pools[i].backups, backup)
+		}
+	}
+	return pools, nil
+}
+
+func buildRoutes(c *config, pools []*pool) ([]*route, error) {
+	if len(c.Routes) == 0 {
+		return []*route{newRoute("/", []*split{{pool: pools[0], weight: 1}})}, nil
+	}
+	var routes []*route
+	for _, rc := range c.Routes {
+		for _, rt := range routes {
+			if rt.prefix == rc.Prefix {
+				return nil, fmt.Errorf("duplicate route %q", rc.Prefix)
+			}
+		}
+		splits := rc.Split
+		if len(splits) == 0 {
+			splits = []splitConfig{{Pool: rc.Pool, Weight: 1}}
+		}
+		var routeSplits []*split
+		for _, sc := range splits {
+			p := poolByName(pools, sc.Pool)
+			if p == nil {
+				return nil, fmt.Errorf("route %q: unknown pool %q", rc.Prefix, sc.Pool)
+			}
+			if sc.Weight < 0 {
+				return nil, fmt.Errorf("route %q: negative weight for pool %q", rc.Prefix, sc.Pool)
+			}
+			routeSplits = append(routeSplits, &split{pool: p, weight: sc.Weight})
+		}
+		rt := newRoute(rc.Prefix, routeSplits)
+		err := rt.setSticky(rc.Sticky)
+		if err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Prefix, err)
+		}
+		rt.overrideHeader = rc.OverrideHeader
+		rt.overrideCookie = rc.OverrideCookie
+		if rc.Mirror != nil {
+			shadow := poolByName(pools, rc.Mirror.Pool)
+			if shadow == nil {
+				return nil, fmt.Errorf("route %q: unknown mirror pool %q", rc.Prefix, rc.Mirror.Pool)
+			}
+			if rc.Mirror.Percent < 0 || rc.Mirror.Percent > 100 {
+				return nil, fmt.Errorf("route %q: mirror percent must be between 0 and 100", rc.Prefix)
+			}
+			rt.mirror = &mirror{pool: shadow, percent: rc.Mirror.Percent}
+		}
+		if rt.errorPages, err = parseErrorPages(rc.ErrorPages); err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Prefix, err)
+		}
+		if rt.acl, err = newIPACL(rc.Allow, rc.Deny); err != nil {
+			return nil, fmt.Errorf("route %q: %w", rc.Prefix, err)
+		}
+		if rt.maintenance, err = newMaintenance(rc.Maintenance); err != nil {
+			return nil, fmt.Errorf("route %q: maintenance: %w", rc.Prefix, err)
+		}
+		if rc.Auth != nil {
+			if rt.auth, err = newAuthenticator(rc.Auth); err != nil {
+				return nil, fmt.Errorf("route %q: auth: %w", rc.Prefix, err)
+			}
+		}
+		if rt.requestHeaders, err = parseHeaderRules(rc.RequestHeaders); err != nil {
+			return nil, fmt.Errorf("route %q: request %w", rc.Prefix, err)
+		}
+		if rt.responseHeaders, err = parseHeaderRules(rc.ResponseHeaders); err != nil {
+			return nil, fmt.Errorf("route %q: response %w", rc.Prefix, err)
+		}
+		routes = append(routes, rt)
+	}
+	return routes, nil
+}
+
+func buildTCPProxies(c *config, pools []*pool) ([]*tcpProxy, error) {
+	var proxies []*tcpProxy
+	ports := map[int]bool{}
+	for _, lc := range c.TCPListeners {
+		p := poolByName(pools, lc.Pool)
+		if p == nil {
+			return nil, fmt.Errorf("tcp listener %d: unknown pool %q", lc.Port, lc.Pool)
+		}
+		if lc.Port <= 0 || ports[lc.Port] {
+			return nil, fmt.Errorf("tcp listener: invalid or duplicate port %d", lc.Port)
+		}
+		ports[lc.Port] = true
+		idle := time.Duration(lc.IdleTimeoutSec) * time.Second
+		if idle <= 0 {
+			idle = defaultTCPIdleTimeout
+		}
+		if lc.SendProxy != 0 && lc.SendProxy != 1 && lc.SendProxy != 2 {
+			return nil, fmt.Errorf("tcp listener %d: unsupported PROXY protocol version %d", lc.Port, lc.SendProxy)
+		}
+		proxy := newTCPProxy(lc.Port, p, idle, lc.MaxConns)
+		proxy.acceptProxy = lc.AcceptProxy
+		proxy.sendProxy = lc.SendProxy
+		proxies = append(proxies, proxy)
+	}
+	return proxies, nil
+}
+
+func parseErrorPages(files map[string]string) (map[int]*template.Template, error) {
+	pages := map[int]*template.Template{}
+	for code, file := range files {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid error page status %q", code)
+		}
+		if pages[status], err = template.ParseFiles(file); err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+func poolByName(pools []*pool, name string) *pool {
+	for _, p := range pools {
+		if p.name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+func mustBuildPools(c *config) []*pool {
+	pools, err := buildPools(c)
+	if err != nil {
+		panic(err)
+	}
+	return pools
+}
+
+func mustBuildRoutes(c *config, pools []*pool) []*route {
+	routes, err := buildRoutes(c, pools)
+	if err != nil {
+		panic(err)
+	}
+	return routes
+}
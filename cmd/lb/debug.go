@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type attemptTiming struct {
+	number  int
+	queue   time.Duration
+	connect time.Duration
+	ttfb    time.Duration
+}
+
+// debugInfo collects what the balancer did with a request. It is only
+// attached to requests when tracing is enabled and is reported back in the
+// Server-Timing and lb-* response headers.
+type debugInfo struct {
+	start time.Time
+
+	mu       sync.Mutex
+	strategy string
+	affinity string
+	tried    []string
+	attempts map[string]*attemptTiming
+}
+
+func withDebugInfo(r *http.Request) *http.Request {
+	d := &debugInfo{start: time.Now(), attempts: map[string]*attemptTiming{}}
+	return r.WithContext(context.WithValue(r.Context(), debugInfoKey, d))
+}
+
+func debugFrom(ctx context.Context) *debugInfo {
+	d, _ := ctx.Value(debugInfoKey).(*debugInfo)
+	return d
+}
+
+func (d *debugInfo) picked(p *pool, addr string) {
+	if d == nil {
+		return
+	}
+	target, _ := p.serving()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.strategy = target.strategy
+	if target.strategy == strategyHash {
+		d.affinity = strconv.Itoa(hashAddress(addr))
+	}
+}
+
+// attempt registers a request to dst and returns its timing record.
+func (d *debugInfo) attempt(dst string) *attemptTiming {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tried = append(d.tried, dst)
+	t := &attemptTiming{number: len(d.tried)}
+	d.attempts[dst] = t
+	return t
+}
+
+func (t *attemptTiming) queued(d time.Duration) {
+	if t != nil {
+		t.queue = d
+	}
+}
+
+// trace measures connection setup and time to first byte of an attempt.
+func (t *attemptTiming) trace(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+	var connectStart, sent time.Time
+	var mu sync.Mutex
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			defer mu.Unlock()
+			sent = time.Now()
+		},
+		ConnectStart: func(string, string) {
+			mu.Lock()
+			defer mu.Unlock()
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			t.connect = time.Since(connectStart)
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			t.ttfb = time.Since(sent)
+		},
+	})
+}
+
+// setHeaders reports the winning attempt to dst on the client response.
+func (d *debugInfo) setHeaders(h http.Header, dst string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	timings := []string{}
+	if t, ok := d.attempts[dst]; ok {
+		timings = append(timings,
+			serverTiming("queue", t.queue),
+			serverTiming("connect", t.connect),
+			serverTiming("ttfb", t.ttfb))
+		h.Set("lb-attempt", strconv.Itoa(t.number))
+	}
+	timings = append(timings, serverTiming("total", time.Since(d.start)))
+	h.Set("Server-Timing", strings.Join(timings, ", "))
+	if d.strategy != "" {
+		h.Set("lb-strategy", d.strategy)
+	}
+	if d.affinity != "" {
+		h.Set("lb-affinity-hash", d.affinity)
+	}
+	if len(d.tried) > 0 {
+		h.Set("lb-tried", strings.Join(d.tried, ","))
+	}
+}
+
+func serverTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, milliseconds(d))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDebugHeaders(t *testing.T) {
+	backendServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("ok"))
+	}))
+	defer backendServer.Close()
+	addr := strings.TrimPrefix(backendServer.URL, "http://")
+
+	defer func(enabled bool) { *traceEnabled = enabled }(*traceEnabled)
+	*traceEnabled = true
+
+	p := &pool{
+		name:       "test",
+		backends:   []*backend{newBackend(addr)},
+		minHealthy: 1,
+		strategy:   strategyHash,
+		active:     "test",
+	}
+	rw := httptest.NewRecorder()
+	serve(p, rw, withDebugInfo(httptest.NewRequest("GET", "/api/v1/some-data", nil)))
+
+	h := rw.Header()
+	for _, metric := range []string{"queue;dur=", "connect;dur=", "ttfb;dur=", "total;dur="} {
+		if !strings.Contains(h.Get("Server-Timing"), metric) {
+			t.Errorf("Server-Timing %q misses %s", h.Get("Server-Timing"), metric)
+		}
+	}
+	expected := map[string]string{
+		"lb-from":          addr,
+		"lb-strategy":      "hash",
+		"lb-affinity-hash": "192021",
+		"lb-attempt":       "1",
+		"lb-tried":         addr,
+	}
+	for name, value := range expected {
+		if h.Get(name) != value {
+			t.Errorf("Unexpected %s header: %q, expected %q", name, h.Get(name), value)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDiscoveryInterval = 30 * time.Second
+	defaultFileCheckInterval = 2 * time.Second
+)
+
+// resolver is the part of net.Resolver used by DNS discovery, so tests can
+// answer lookups without a DNS server.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+var dnsResolver resolver = net.DefaultResolver
+
+// dnsDiscovery re-resolves a host name or an SRV record on an interval and
+// makes every address it resolves to a separate backend of the pool.
+type dnsDiscovery struct {
+	host     string
+	port     string
+	srv      string
+	interval time.Duration
+}
+
+func newDNSDiscovery(c *discoveryConfig) (*dnsDiscovery, error) {
+	d := &dnsDiscovery{srv: c.SRV, interval: time.Duration(c.IntervalSec) * time.Second}
+	if d.interval <= 0 {
+		d.interval = defaultDiscoveryInterval
+	}
+	switch {
+	case c.DNS != "" && c.SRV != "":
+		return nil, fmt.Errorf("both dns and srv are set")
+	case c.DNS != "":
+		var err error
+		if d.host, d.port, err = net.SplitHostPort(c.DNS); err != nil {
+			return nil, fmt.Errorf("dns: %w", err)
+		}
+	case c.SRV == "":
+		return nil, fmt.Errorf("dns or srv is required")
+	}
+	return d, nil
+}
+
+func (d *dnsDiscovery) name() string {
+	if d.srv != "" {
+		return d.srv
+	}
+	return d.host
+}
+
+// resolve returns the sorted backend addresses the record points to.
+func (d *dnsDiscovery) resolve(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if d.srv != "" {
+		_, records, err := dnsResolver.LookupSRV(ctx, "", "", d.srv)
+		if err != nil {
+			return nil, err
+		}
+		for _, srv := range records {
+			host := strings.TrimSuffix(srv.Target, ".")
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	} else {
+		hosts, err := dnsResolver.LookupHost(ctx, d.host)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, d.port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no records for %s", d.name())
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// refresh resolves the record once and updates the backends of p. Failed
+// lookups keep the current backends.
+func (d *dnsDiscovery) refresh(p *pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addrs, err := d.resolve(ctx)
+	if err != nil {
+		log.Printf("Discovery of %s for pool %s failed: %s", d.name(), p.name, err)
+		incCounter("lb_discovery_errors_total", "pool", p.name)
+		return
+	}
+	applyBackends(p, addrs)
+}
+
+func (d *dnsDiscovery) run(p *pool) {
+	d.refresh(p)
+	for range time.Tick(d.interval) {
+		d.refresh(p)
+	}
+}
+
+// applyBackends updates the backends of p, starting health checks of the new
+// ones and stopping those of the removed ones.
+func applyBackends(p *pool, addrs []string) {
+	added, removed := p.setBackends(addrs)
+	for _, b := range added {
+		log.Printf("Backend %s added to pool %s", b.addr, p.name)
+		go checkNewBackend(p, b)
+	}
+	for _, b := range removed {
+		log.Printf("Backend %s removed from pool %s", b.addr, p.name)
+		b.retire()
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		incCounter("lb_discovery_updates_total", "pool", p.name)
+	}
+}
+
+// fileDiscovery watches a file of backend addresses grouped by pool, either
+// JSON like {"servers": ["server1:8080"]} or text with a [pool] line before
+// the addresses of each pool. Pools missing from the file are left as is.
+type fileDiscovery struct {
+	path     string
+	interval time.Duration
+	pools    map[string]*pool
+
+	last [sha256.Size]byte
+}
+
+func newFileDiscovery(path string, interval time.Duration, pools []*pool) *fileDiscovery {
+	f := &fileDiscovery{path: path, interval: interval, pools: map[string]*pool{}}
+	for _, p := range pools {
+		f.pools[p.name] = p
+	}
+	return f
+}
+
+func parseBackendsFile(data []byte) (map[string][]string, error) {
+	groups := map[string][]string{}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '{' {
+		if err := json.Unmarshal(trimmed, &groups); err != nil {
+			return nil, err
+		}
+		for name, addrs := range groups {
+			seen := map[string]bool{}
+			for _, addr := range addrs {
+				if err := validBackendAddr(addr); err != nil {
+					return nil, fmt.Errorf("pool %q: invalid backend address %q: %w", name, addr, err)
+				}
+				if seen[addr] {
+					return nil, fmt.Errorf("pool %q: duplicate backend %q", name, addr)
+				}
+				seen[addr] = true
+			}
+		}
+		return groups, nil
+	}
+	current := ""
+	seen := map[string]bool{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]"):
+			current = strings.TrimSpace(line[1 : len(line)-1])
+			groups[current] = []string{}
+			seen = map[string]bool{}
+		case current == "":
+			return nil, fmt.Errorf("line %d: address outside of a [pool] section", i+1)
+		default:
+			if err := validBackendAddr(line); err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			if seen[line] {
+				return nil, fmt.Errorf("line %d: duplicate backend %q", i+1, line)
+			}
+			seen[line] = true
+			groups[current] = append(groups[current], line)
+		}
+	}
+	return groups, nil
+}
+
+// refresh applies the file if it changed since the last refresh. A file that
+// can't be read or parsed keeps the current backends.
+func (f *fileDiscovery) refresh() {
+	data, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		log.Printf("Failed to read backends file %s: %s", f.path, err)
+		incCounter("lb_discovery_errors_total", "file", f.path)
+		return
+	}
+	sum := sha256.Sum256(data)
+	if sum == f.last {
+		return
+	}
+	groups, err := parseBackendsFile(data)
+	if err != nil {
+		log.Printf("Invalid backends file %s: %s", f.path, err)
+		incCounter("lb_discovery_errors_total", "file", f.path)
+		return
+	}
+	f.last = sum
+	for name, addrs := range groups {
+		p, ok := f.pools[name]
+		if !ok {
+			log.Printf("Backends file %s lists unknown pool %s", f.path, name)
+			continue
+		}
+		applyBackends(p, addrs)
+	}
+}
+
+func (f *fileDiscovery) run() {
+	f.refresh()
+	for range time.Tick(f.interval) {
+		f.refresh()
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeResolver struct {
+	hosts map[string][]string
+	srv   map[string][]*net.SRV
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, fmt.Errorf("no such host %s", host)
+}
+
+func (r *fakeResolver) LookupSRV(_ context.Context, _, _, name string) (string, []*net.SRV, error) {
+	if records, ok := r.srv[name]; ok {
+		return name, records, nil
+	}
+	return "", nil, fmt.Errorf("no such record %s", name)
+}
+
+func addrs(backends []*backend) []string {
+	list := []string{}
+	for _, b := range backends {
+		list = append(list, b.addr)
+	}
+	return list
+}
+
+func TestDNSDiscovery(t *testing.T) {
+	fake := &fakeResolver{
+		hosts: map[string][]string{"servers": {"10.0.0.2", "10.0.0.1"}},
+		srv: map[string][]*net.SRV{"_http._tcp.servers": {
+			{Target: "server1.", Port: 8080},
+			{Target: "server2.", Port: 8081},
+		}},
+	}
+	defer func(r resolver) { dnsResolver = r }(dnsResolver)
+	dnsResolver = fake
+
+	d, err := newDNSDiscovery(&discoveryConfig{DNS: "servers:8080"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &pool{name: "servers", backends: []*backend{newBackend("10.0.0.1:8080"), newBackend("seed:8080")}}
+	kept := p.backends[0]
+	kept.setHealthy(false)
+	d.refresh(p)
+	if list := addrs(p.list()); !reflect.DeepEqual(list, []string{"10.0.0.1:8080", "10.0.0.2:8080"}) {
+		t.Errorf("Unexpected backends %v", list)
+	}
+	if p.list()[0] != kept || kept.isHealthy() {
+		t.Errorf("Existing backend state was not kept")
+	}
+	if p.list()[1].isHealthy() {
+		t.Errorf("Discovered backend is healthy before a health check")
+	}
+
+	fake.hosts["servers"] = nil
+	d.refresh(p)
+	if len(p.list()) != 2 {
+		t.Errorf("Failed lookup removed backends")
+	}
+
+	d, err = newDNSDiscovery(&discoveryConfig{SRV: "_http._tcp.servers"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.refresh(p)
+	if list := addrs(p.list()); !reflect.DeepEqual(list, []string{"server1:8080", "server2:8081"}) {
+		t.Errorf("Unexpected SRV backends %v", list)
+	}
+	select {
+	case <-kept.done:
+	default:
+		t.Errorf("Removed backend was not retired")
+	}
+
+	if _, err := newDNSDiscovery(&discoveryConfig{DNS: "servers"}); err == nil {
+		t.Errorf("DNS name without port accepted")
+	}
+}
+
+func TestFileDiscovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends")
+	servers := &pool{name: "servers", backends: []*backend{newBackend("server1:8080"), newBackend("server2:8080")}}
+	static := &pool{name: "static", backends: []*backend{newBackend("static:8080")}}
+	f := newFileDiscovery(path, time.Second, []*pool{servers, static})
+	kept := servers.backends[1]
+	kept.connect()
+
+	write := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f.refresh()
+	}
+	write("# managed by orchestration\n[servers]\nserver2:8080\nserver3:8080\n")
+	if list := addrs(servers.list()); !reflect.DeepEqual(list, []string{"server2:8080", "server3:8080"}) {
+		t.Errorf("Unexpected backends %v", list)
+	}
+	if servers.list()[0] != kept || kept.activeConns() != 1 || !kept.isHealthy() {
+		t.Errorf("Existing backend state was not kept")
+	}
+	if servers.list()[1].isHealthy() {
+		t.Errorf("Backend from the file is healthy before a health check")
+	}
+	if list := addrs(static.list()); !reflect.DeepEqual(list, []string{"static:8080"}) {
+		t.Errorf("Pool missing from the file changed: %v", list)
+	}
+
+	for _, content := range []string{
+		"[servers]\nnot an address\n",
+		"[servers]\nserver2:8080\nserver2:8080\n",
+		`{"servers": ["not an address"]}`,
+		`{"servers": ["server2:8080", "server2:8080"]}`,
+	} {
+		write(content)
+		if len(servers.list()) != 2 {
+			t.Errorf("Invalid file was applied: %s", content)
+		}
+	}
+
+	write(`{"servers": ["server4:8080"], "static": []}`)
+	if list := addrs(servers.list()); !reflect.DeepEqual(list, []string{"server4:8080"}) {
+		t.Errorf("Unexpected backends from JSON %v", list)
+	}
+	if len(static.list()) != 0 {
+		t.Errorf("Backends were not removed")
+	}
+}
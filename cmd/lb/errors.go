@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
+)
+
+const (
+	errNoRoute             = "no_route"
+	errAccessDenied        = "access_denied"
+	errUnauthorized        = "unauthorized"
+	errMaintenance         = "maintenance"
+	errNoBackend           = "no_backend_available"
+	errBackendOverloaded   = "backend_overloaded"
+	errUpstreamTimeout     = "upstream_timeout"
+	errUpstreamUnreachable = "upstream_unreachable"
+)
+
+// errorResponse is the body of every response generated by the balancer
+// itself, as opposed to responses forwarded from backends.
+type errorResponse struct {
+	Status     int    `json:"status"`
+	StatusText string `json:"-"`
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	RequestID  string `json:"request_id,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+var defaultErrorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Status}} {{.StatusText}}</title></head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .RetryAfter}}<p>Please retry in {{.RetryAfter}} seconds.</p>{{end}}
+{{if .RequestID}}<p><small>Request ID: {{.RequestID}}</small></p>{{end}}
+</body>
+</html>
+`))
+
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	htmlPos := strings.Index(accept, "text/html")
+	jsonPos := strings.Index(accept, "application/json")
+	return htmlPos >= 0 && (jsonPos < 0 || htmlPos < jsonPos)
+}
+
+// writeError renders an error as JSON, or as HTML for browsers using the
+// template configured on the route for the status if there is one.
+func writeError(rw http.ResponseWriter, r *http.Request, status int, code, message string, retryAfter int) {
+	resp := errorResponse{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Error:      code,
+		Message:    message,
+		RequestID:  r.Header.Get(tracing.RequestIDHeader),
+		RetryAfter: retryAfter,
+	}
+	if retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+	if !wantsHTML(r) {
+		writeJSON(rw, status, resp)
+		return
+	}
+
+	page := defaultErrorPage
+	if rt := matchRoute(routes, r.URL.Path); rt != nil && rt.errorPages[status] != nil {
+		page = rt.errorPages[status]
+	}
+	rw.Header().Set("content-type", "text/html; charset=utf-8")
+	rw.WriteHeader(status)
+	if err := page.Execute(rw, resp); err != nil {
+		log.Printf("Failed to render error page: %s", err)
+	}
+}
+
+// writeUpstreamError reports a failure to get a response from a backend.
+func writeUpstreamError(rw http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errOverloaded):
+		retryAfter := int(math.Ceil((*queueTimeout).Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		writeError(rw, r, http.StatusServiceUnavailable, errBackendOverloaded, "All backends are busy", retryAfter)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(rw, r, http.StatusGatewayTimeout, errUpstreamTimeout, "The backend did not respond in time", 0)
+	default:
+		writeError(rw, r, http.StatusBadGateway, errUpstreamUnreachable, "The backend could not be reached", 0)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteErrorJSON(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	rw := httptest.NewRecorder()
+	writeError(rw, r, http.StatusServiceUnavailable, errNoBackend, "No healthy backends available", 10)
+
+	var body errorResponse
+	if err := json.Unmarshal(rw.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Error body is not JSON: %q", rw.Body.String())
+	}
+	if body.Status != 503 || body.Error != errNoBackend || body.RequestID != "abc" || body.RetryAfter != 10 {
+		t.Errorf("Unexpected error body %+v", body)
+	}
+	if rw.Code != 503 || rw.Header().Get("Retry-After") != "10" {
+		t.Errorf("Unexpected response %d %v", rw.Code, rw.Header())
+	}
+}
+
+func TestWriteErrorHTML(t *testing.T) {
+	defer func(original []*route) { routes = original }(routes)
+	rt := newRoute("/", nil)
+	rt.errorPages = map[int]*template.Template{
+		502: template.Must(template.New("502").Parse("custom {{.Error}} {{.RequestID}}")),
+	}
+	routes = []*route{rt}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "text/html,application/xhtml+xml")
+	r.Header.Set("X-Request-ID", "abc")
+
+	rw := httptest.NewRecorder()
+	writeUpstreamError(rw, r, errors.New("connection refused"))
+	if rw.Code != 502 || rw.Body.String() != "custom upstream_unreachable abc" {
+		t.Errorf("Unexpected custom page %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = httptest.NewRecorder()
+	writeUpstreamError(rw, r, errOverloaded)
+	if rw.Code != 503 || !strings.Contains(rw.Body.String(), "<h1>503 Service Unavailable</h1>") {
+		t.Errorf("Unexpected default page %d %q", rw.Code, rw.Body.String())
+	}
+	if rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Overload response without Retry-After")
+	}
+
+	rw = httptest.NewRecorder()
+	writeUpstreamError(rw, r, context.DeadlineExceeded)
+	if rw.Code != 504 {
+		t.Errorf("Expected gateway timeout, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"text/template"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
+)
+
+const (
+	headerAdd     = "add"
+	headerSet     = "set"
+	headerRemove  = "remove"
+	headerReplace = "replace"
+)
+
+// headerRule changes one header. Values are templates over headerVars, e.g.
+// "{{.ClientIP}}".
+type headerRule struct {
+	action  string
+	name    string
+	value   *template.Template
+	pattern *regexp.Regexp
+}
+
+type headerVars struct {
+	ClientIP  string
+	Backend   string
+	RequestID string
+	Host      string
+	Method    string
+	Path      string
+}
+
+func newHeaderVars(r *http.Request, backend string) headerVars {
+	return headerVars{
+		ClientIP:  clientIP(r),
+		Backend:   backend,
+		RequestID: r.Header.Get(tracing.RequestIDHeader),
+		Host:      r.Host,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+	}
+}
+
+func parseHeaderRules(configs []headerRuleConfig) ([]*headerRule, error) {
+	var rules []*headerRule
+	for _, hc := range configs {
+		if hc.Name == "" {
+			return nil, fmt.Errorf("header rule without a name")
+		}
+		rule := &headerRule{action: hc.Action, name: http.CanonicalHeaderKey(hc.Name)}
+		switch hc.Action {
+		case headerAdd, headerSet, headerRemove:
+		case headerReplace:
+			pattern, err := regexp.Compile(hc.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", hc.Name, err)
+			}
+			rule.pattern = pattern
+		default:
+			return nil, fmt.Errorf("header %s: unknown action %q", hc.Name, hc.Action)
+		}
+		value, err := template.New(hc.Name).Parse(hc.Value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", hc.Name, err)
+		}
+		// Unknown fields like {{.ClientIp}} only fail when executed.
+		if err := value.Execute(ioutil.Discard, headerVars{}); err != nil {
+			return nil, fmt.Errorf("header %s: %w", hc.Name, err)
+		}
+		rule.value = value
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func (rule *headerRule) render(vars headerVars) (string, bool) {
+	var buf bytes.Buffer
+	if err := rule.value.Execute(&buf, vars); err != nil {
+		log.Printf("Failed to render header %s: %s", rule.name, err)
+		return "", false
+	}
+	return buf.String(), true
+}
+
+// applyResponseRules applies the response header rules of the route of r.
+func applyResponseRules(h http.Header, r *http.Request, backend string) {
+	if rt := matchRoute(routes, r.URL.Path); rt != nil {
+		applyHeaderRules(rt.responseHeaders, h, newHeaderVars(r, backend))
+	}
+}
+
+func applyHeaderRules(rules []*headerRule, h http.Header, vars headerVars) {
+	for _, rule := range rules {
+		if rule.action == headerRemove {
+			h.Del(rule.name)
+			continue
+		}
+		value, ok := rule.render(vars)
+		if !ok {
+			continue
+		}
+		switch rule.action {
+		case headerAdd:
+			h.Add(rule.name, value)
+		case headerSet:
+			h.Set(rule.name, value)
+		case headerReplace:
+			values := h.Values(rule.name)
+			for i, v := range values {
+				values[i] = rule.pattern.ReplaceAllString(v, value)
+			}
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeaderRules(t *testing.T) {
+	rules, err := parseHeaderRules([]headerRuleConfig{
+		{Action: "remove", Name: "lb-author"},
+		{Action: "remove", Name: "lb-req-cnt"},
+		{Action: "set", Name: "X-Content-Type-Options", Value: "nosniff"},
+		{Action: "add", Name: "X-Forwarded-For", Value: "{{.ClientIP}}"},
+		{Action: "set", Name: "X-Upstream", Value: "{{.Backend}} {{.RequestID}}"},
+		{Action: "replace", Name: "Location", Pattern: `^http://server\d:8080`, Value: "https://example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.Header.Set("X-Request-ID", "abc")
+	h := http.Header{}
+	h.Set("lb-author", "someone")
+	h.Set("lb-req-cnt", "1")
+	h.Set("X-Forwarded-For", "10.0.0.1")
+	h.Set("Location", "http://server2:8080/report")
+	applyHeaderRules(rules, h, newHeaderVars(r, "server1:8080"))
+
+	if h.Get("lb-author") != "" || h.Get("lb-req-cnt") != "" {
+		t.Errorf("Internal headers were not removed: %v", h)
+	}
+	expected := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Upstream":             "server1:8080 abc",
+		"Location":               "https://example.com/report",
+	}
+	for name, value := range expected {
+		if h.Get(name) != value {
+			t.Errorf("Unexpected %s: %q, expected %q", name, h.Get(name), value)
+		}
+	}
+	if xff := h.Values("X-Forwarded-For"); len(xff) != 2 || xff[1] != "192.0.2.1" {
+		t.Errorf("Unexpected X-Forwarded-For %v", xff)
+	}
+}
+
+func TestHeaderRulesValidation(t *testing.T) {
+	for _, invalid := range []headerRuleConfig{
+		{Action: "rename", Name: "X-Test"},
+		{Action: "replace", Name: "X-Test", Pattern: "("},
+		{Action: "set", Name: "X-Test", Value: "{{.Missing"},
+		{Action: "set", Name: "X-Test", Value: "{{.ClientIp}}"},
+		{Action: "set"},
+	} {
+		if _, err := parseHeaderRules([]headerRuleConfig{invalid}); err == nil {
+			t.Errorf("Invalid rule %+v accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindowSize  = 200
+	minLatencySamples  = 20
+	defaultHedgeDelay  = 100 * time.Millisecond
+	hedgeBudgetBurst   = 10
+	hedgeLatencyTarget = 0.95
+)
+
+// latencyWindow keeps the most recent upstream latencies of a route.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (w *latencyWindow) add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < latencyWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile returns false until enough samples are collected.
+func (w *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(p*float64(len(sorted)-1))], true
+}
+
+// hedgeBudget is a token bucket refilled by every request on a hedged route,
+// so hedges never exceed the configured share of that traffic.
+type hedgeBudget struct {
+	mu      sync.Mutex
+	percent float64
+	tokens  float64
+}
+
+func (b *hedgeBudget) request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens += b.percent / 100
+	if b.tokens > hedgeBudgetBurst {
+		b.tokens = hedgeBudgetBurst
+	}
+}
+
+func (b *hedgeBudget) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+var (
+	hedgeLatencies = map[string]*latencyWindow{}
+	budget         = &hedgeBudget{}
+)
+
+func initHedging() {
+	budget.percent = *hedgeBudgetPercent
+	for _, route := range strings.Split(*hedgeRoutes, ",") {
+		route = strings.TrimSpace(route)
+		if route != "" {
+			hedgeLatencies[route] = &latencyWindow{}
+		}
+	}
+}
+
+func shouldHedge(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	_, ok := hedgeLatencies[r.URL.Path]
+	return ok
+}
+
+func hedgeDelayFor(path string) time.Duration {
+	if *hedgeDelay > 0 {
+		return *hedgeDelay
+	}
+	if d, ok := hedgeLatencies[path].percentile(hedgeLatencyTarget); ok {
+		return d
+	}
+	return defaultHedgeDelay
+}
+
+type attempt struct {
+	dst     string
+	resp    *http.Response
+	err     error
+	elapsed time.Duration
+}
+
+// forwardHedged sends the request to dst and, if it has not answered within
+// the hedge delay, a second copy to another healthy backend of p. The first
+// successful response is returned to the client and the other one cancelled.
+func forwardHedged(p *pool, dst string, rw http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	path := r.URL.Path
+	budget.request()
+
+	results := make(chan attempt, 2)
+	cancels := map[string]context.CancelFunc{}
+	send := func(dst string) {
+		attemptCtx, attemptCancel := context.WithCancel(ctx)
+		cancels[dst] = attemptCancel
+		go func() {
+			start := time.Now()
+			resp, err := roundTrip(attemptCtx, dst, r)
+			results <- attempt{dst, resp, err, time.Since(start)}
+		}()
+	}
+	primaryStart := time.Now()
+	send(dst)
+	pending := 1
+
+	timer := time.NewTimer(hedgeDelayFor(path))
+	defer timer.Stop()
+
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if alt, ok := p.alternate(dst); ok && budget.allow() {
+				log.Printf("Hedging %s to %s", path, alt)
+				send(alt)
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				lastErr = res.err
+				continue
+			}
+			for other, cancelAttempt := range cancels {
+				if other != res.dst {
+					cancelAttempt()
+				}
+			}
+			go discardAttempts(results, pending)
+			// The delay follows the latency of primary attempts. A winning
+			// hedge cuts the primary short, which took at least this long.
+			elapsed := res.elapsed
+			if res.dst != dst {
+				elapsed = time.Since(primaryStart)
+			}
+			hedgeLatencies[path].add(elapsed)
+			writeResponse(res.dst, rw, res.resp)
+			return
+		}
+	}
+	log.Printf("Failed to get response from %s: %s", dst, lastErr)
+	writeUpstreamError(rw, r, lastErr)
+}
+
+// discardAttempts releases the responses of cancelled attempts.
+func discardAttempts(results <-chan attempt, pending int) {
+	for ; pending > 0; pending-- {
+		if res := <-results; res.resp != nil {
+			res.resp.Body.Close()
+		}
+	}
+}
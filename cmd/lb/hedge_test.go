@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindow(t *testing.T) {
+	w := &latencyWindow{}
+	if _, ok := w.percentile(0.95); ok {
+		t.Error("Percentile reported without enough samples")
+	}
+	for i := 1; i <= 100; i++ {
+		w.add(time.Duration(i) * time.Millisecond)
+	}
+	if p95, _ := w.percentile(0.95); p95 != 95*time.Millisecond {
+		t.Errorf("Unexpected p95 latency: %s", p95)
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	b := &hedgeBudget{percent: 25}
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		b.request()
+		if b.allow() {
+			allowed++
+		}
+	}
+	if allowed != 25 {
+		t.Errorf("Expected 25 hedged requests out of 100, got %d", allowed)
+	}
+}
+
+func TestForwardHedged(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		_, _ = rw.Write([]byte("slow"))
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+
+	slowAddr := strings.TrimPrefix(slow.URL, "http://")
+	fastAddr := strings.TrimPrefix(fast.URL, "http://")
+	p := &pool{
+		name:       "test",
+		backends:   []*backend{newBackend(slowAddr), newBackend(fastAddr)},
+		minHealthy: 1,
+		active:     "test",
+	}
+
+	defer func(delay time.Duration, savedBudget *hedgeBudget, latencies map[string]*latencyWindow) {
+		*hedgeDelay, budget, hedgeLatencies = delay, savedBudget, latencies
+	}(*hedgeDelay, budget, hedgeLatencies)
+	*hedgeDelay = 10 * time.Millisecond
+	budget = &hedgeBudget{percent: 100}
+	hedgeLatencies = map[string]*latencyWindow{"/api/v1/some-data": {}}
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	if !shouldHedge(r) {
+		t.Fatal("Route is not hedged")
+	}
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	forwardHedged(p, slowAddr, rw, r)
+	if body := rw.Body.String(); body != "fast" {
+		t.Errorf("Expected response from the hedged backend, got %q", body)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Hedged request took %s", elapsed)
+	}
+	if samples := hedgeLatencies["/api/v1/some-data"].samples; len(samples) != 1 || samples[0] < *hedgeDelay {
+		t.Errorf("Expected the primary latency to be recorded, got %v", samples)
+	}
+}
+
+func TestHedgeAlternate(t *testing.T) {
+	p := &pool{
+		name:       "test",
+		backends:   []*backend{newBackend("server1:8080"), newBackend("server2:8080"), newBackend("server3:8080")},
+		minHealthy: 1,
+		active:     "test",
+	}
+	picked := map[string]int{}
+	for i := 0; i < 100; i++ {
+		alt, ok := p.alternate("server1:8080")
+		if !ok || alt == "server1:8080" {
+			t.Fatalf("Unexpected alternate %q", alt)
+		}
+		picked[alt]++
+	}
+	if picked["server2:8080"] == 0 || picked["server3:8080"] == 0 {
+		t.Errorf("Hedges did not spread over the pool: %v", picked)
+	}
+	p.backends = p.backends[:1]
+	if _, ok := p.alternate("server1:8080"); ok {
+		t.Errorf("Alternate found without another backend")
+	}
+}
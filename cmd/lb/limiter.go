@@ -0,0 +1,148 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+const aimdBackoff = 0.9
+
+var errOverloaded = errors.New("backend is overloaded")
+
+// limiter caps the number of concurrent requests to one backend. Requests over
+// the limit wait in a bounded FIFO queue. With adaptive limiting the limit is
+// lowered multiplicatively on slow or failed responses and raised additively
+// otherwise, never exceeding the configured maximum.
+type limiter struct {
+	mu        sync.Mutex
+	limit     float64
+	max       float64
+	inFlight  int
+	waiters   *list.List
+	queueSize int
+	adaptive  bool
+	target    time.Duration
+}
+
+func newLimiter(max, queueSize int, adaptive bool, target time.Duration) *limiter {
+	return &limiter{
+		limit:     float64(max),
+		max:       float64(max),
+		waiters:   list.New(),
+		queueSize: queueSize,
+		adaptive:  adaptive,
+		target:    target,
+	}
+}
+
+func (l *limiter) acquire(ctx context.Context, queueTimeout time.Duration) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.waiters.Len() == 0 && l.inFlight < l.currentLimit() {
+		l.inFlight++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.waiters.Len() >= l.queueSize {
+		l.mu.Unlock()
+		return fmt.Errorf("%w: queue is full", errOverloaded)
+	}
+	ready := make(chan struct{})
+	elem := l.waiters.PushBack(ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(queueTimeout)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-ready:
+		// The slot was granted while timing out, hand it over to the next waiter.
+		l.inFlight--
+		l.admit()
+	default:
+		l.waiters.Remove(elem)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%w: queue timeout", errOverloaded)
+}
+
+func (l *limiter) release(latency time.Duration, ok bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+	if l.adaptive {
+		if ok && latency <= l.target {
+			l.limit = math.Min(l.max, l.limit+1/l.limit)
+		} else {
+			l.limit = math.Max(1, l.limit*aimdBackoff)
+		}
+	}
+	l.admit()
+}
+
+// admit wakes queued requests while there is spare capacity. Must be called
+// with l.mu held.
+func (l *limiter) admit() {
+	for l.waiters.Len() > 0 && l.inFlight < l.currentLimit() {
+		ready := l.waiters.Remove(l.waiters.Front()).(chan struct{})
+		l.inFlight++
+		close(ready)
+	}
+}
+
+func (l *limiter) currentLimit() int {
+	return int(l.limit)
+}
+
+// releasingBody returns the backend slot once the response is fully consumed.
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+var (
+	limitersMu sync.Mutex
+	limiters   = map[string]*limiter{}
+)
+
+func limiterFor(dst string) *limiter {
+	if *maxConcurrent <= 0 {
+		return nil
+	}
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+	l, ok := limiters[dst]
+	if !ok {
+		l = newLimiter(*maxConcurrent, *queueSize, *adaptiveLimit, *adaptiveLatency)
+		limiters[dst] = l
+	}
+	return l
+}
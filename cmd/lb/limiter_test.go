@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterQueue(t *testing.T) {
+	l := newLimiter(1, 1, false, 0)
+	ctx := context.Background()
+	if err := l.acquire(ctx, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan error)
+	go func() {
+		admitted <- l.acquire(ctx, time.Second)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := l.acquire(ctx, time.Second); !errors.Is(err, errOverloaded) {
+		t.Errorf("Expected full queue error, got %v", err)
+	}
+
+	l.release(0, true)
+	if err := <-admitted; err != nil {
+		t.Errorf("Queued request was not admitted: %s", err)
+	}
+
+	if err := l.acquire(ctx, 10*time.Millisecond); !errors.Is(err, errOverloaded) {
+		t.Errorf("Expected queue timeout error, got %v", err)
+	}
+	if l.waiters.Len() != 0 {
+		t.Errorf("Timed out request left in queue")
+	}
+}
+
+func TestLimiterAdaptive(t *testing.T) {
+	l := newLimiter(10, 0, true, 100*time.Millisecond)
+	for i := 0; i < 10; i++ {
+		_ = l.acquire(context.Background(), 0)
+		l.release(time.Second, true)
+	}
+	if limit := l.currentLimit(); limit >= 10 {
+		t.Errorf("Limit was not lowered on slow responses: %d", limit)
+	}
+	lowered := l.limit
+	for i := 0; i < 10; i++ {
+		_ = l.acquire(context.Background(), 0)
+		l.release(time.Millisecond, true)
+	}
+	if l.limit <= lowered {
+		t.Errorf("Limit was not raised on fast responses: %f", l.limit)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// loadHeader carries the load a backend reports on /health, e.g.
+// "inflight=3, queue=0, capacity=10".
+const loadHeader = "X-Backend-Load"
+
+// minLoadFactor keeps a fully loaded backend in rotation for some clients.
+const minLoadFactor = 0.1
+
+type loadReport struct {
+	InFlight int `json:"inflight"`
+	Queue    int `json:"queue"`
+	Capacity int `json:"capacity"`
+}
+
+// parseLoad reads the load report from the header or, for JSON responses,
+// from the body of a health check response. It returns nil if the backend
+// reports no capacity.
+func parseLoad(resp *http.Response) *loadReport {
+	var report loadReport
+	if value := resp.Header.Get(loadHeader); value != "" {
+		for _, part := range strings.Split(value, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			n, err := strconv.Atoi(kv[1])
+			if err != nil {
+				continue
+			}
+			switch kv[0] {
+			case "inflight":
+				report.InFlight = n
+			case "queue":
+				report.Queue = n
+			case "capacity":
+				report.Capacity = n
+			}
+		}
+	} else if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType == "application/json" {
+		_ = json.NewDecoder(io.LimitReader(resp.Body, 4<<10)).Decode(&report)
+	}
+	if report.Capacity <= 0 {
+		return nil
+	}
+	return &report
+}
+
+// factor is the share of capacity the backend has free, which scales its
+// weight.
+func (l *loadReport) factor() float64 {
+	free := 1 - float64(l.InFlight+l.Queue)/float64(l.Capacity)
+	if free < minLoadFactor {
+		return minLoadFactor
+	}
+	if free > 1 {
+		return 1
+	}
+	return free
+}
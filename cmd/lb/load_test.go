@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestParseLoad(t *testing.T) {
+	header := &http.Response{Header: http.Header{loadHeader: {"inflight=6, queue=2, capacity=10"}}}
+	if l := parseLoad(header); l == nil || l.factor() < 0.19 || l.factor() > 0.21 {
+		t.Errorf("Unexpected load from header: %+v", l)
+	}
+	body := &http.Response{
+		Header: http.Header{"Content-Type": {"application/json"}},
+		Body:   ioutil.NopCloser(strings.NewReader(`{"inflight": 30, "queue": 5, "capacity": 10}`)),
+	}
+	if l := parseLoad(body); l == nil || l.factor() != minLoadFactor {
+		t.Errorf("Unexpected load from body: %+v", l)
+	}
+	plain := &http.Response{Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("OK"))}
+	if l := parseLoad(plain); l != nil {
+		t.Errorf("Load reported without a capacity: %+v", l)
+	}
+}
+
+func TestLoadWeights(t *testing.T) {
+	p := &pool{
+		name:       "servers",
+		backends:   []*backend{newBackend("server1:8080"), newBackend("server2:8080")},
+		minHealthy: 1,
+		strategy:   strategyHash,
+		active:     "servers",
+	}
+	loaded := p.backends[0]
+	for i := 0; i < 10; i++ {
+		loaded.reportLoad(minLoadFactor)
+	}
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		if b, _ := p.pick(fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)); b == loaded {
+			picked++
+		}
+	}
+	if picked == 0 || picked > 150 {
+		t.Errorf("Loaded backend got %d of 1000 clients", picked)
+	}
+
+	// Similar load across the pool keeps most clients where they hash to.
+	loaded.load = 1
+	expected := map[string]*backend{}
+	for i := 0; i < 1000; i++ {
+		addr := fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)
+		expected[addr], _ = p.pick(addr)
+	}
+	p.backends[0].reportLoad(0.6)
+	p.backends[1].reportLoad(0.5)
+	moved := 0
+	for addr, b := range expected {
+		if picked, _ := p.pick(addr); picked != b {
+			moved++
+		}
+	}
+	if moved > 50 {
+		t.Errorf("%d of 1000 clients moved under similar load", moved)
+	}
+	loaded.load = minLoadFactor
+
+	p.strategy = strategyLeastConnections
+	p.backends[1].connect()
+	p.backends[1].connect()
+	if b, _ := p.pick(""); b == loaded {
+		t.Errorf("Least connections ignored the reported load")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	defaultMaintenanceMessage    = "The service is down for maintenance"
+	defaultMaintenanceRetryAfter = 300
+)
+
+// maintenance answers requests with 503 while enabled, except for clients
+// from the allowlist and requests carrying the bypass header. The HTML page
+// is the 503 error page of the route.
+type maintenance struct {
+	allow        []*net.IPNet
+	bypassHeader string
+	bypassToken  string
+
+	mu         sync.RWMutex
+	enabled    bool
+	message    string
+	retryAfter int
+}
+
+type maintenanceState struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message,omitempty"`
+	RetryAfter int    `json:"retryAfter,omitempty"`
+}
+
+func newMaintenance(c *maintenanceConfig) (*maintenance, error) {
+	m := &maintenance{message: defaultMaintenanceMessage, retryAfter: defaultMaintenanceRetryAfter}
+	if c == nil {
+		return m, nil
+	}
+	var err error
+	if m.allow, err = parseCIDRs(c.Allow); err != nil {
+		return nil, err
+	}
+	m.bypassHeader, m.bypassToken = c.BypassHeader, c.BypassToken
+	m.set(maintenanceState{Enabled: c.Enabled, Message: c.Message, RetryAfter: c.RetryAfterSec})
+	return m, nil
+}
+
+// set changes the state, keeping the message and Retry-After that are not
+// given.
+func (m *maintenance) set(s maintenanceState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.enabled = s.Enabled
+	if s.Message != "" {
+		m.message = s.Message
+	}
+	if s.RetryAfter > 0 {
+		m.retryAfter = s.RetryAfter
+	}
+}
+
+func (m *maintenance) state() maintenanceState {
+	if m == nil {
+		return maintenanceState{}
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return maintenanceState{Enabled: m.enabled, Message: m.message, RetryAfter: m.retryAfter}
+}
+
+func (m *maintenance) isEnabled() bool {
+	return m.state().Enabled
+}
+
+func (m *maintenance) bypassed(r *http.Request) bool {
+	if m.bypassHeader != "" && m.bypassToken != "" && r.Header.Get(m.bypassHeader) == m.bypassToken {
+		return true
+	}
+	ip := net.ParseIP(clientIP(r))
+	return ip != nil && containsIP(m.allow, ip)
+}
+
+// blocks writes the maintenance response and returns true if r has to wait
+// for the maintenance to end.
+func (m *maintenance) blocks(rw http.ResponseWriter, r *http.Request) bool {
+	s := m.state()
+	if !s.Enabled || m.bypassed(r) {
+		return false
+	}
+	writeError(rw, r, http.StatusServiceUnavailable, errMaintenance, s.Message, s.RetryAfter)
+	return true
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaintenance(t *testing.T) {
+	m, err := newMaintenance(&maintenanceConfig{
+		Enabled:       true,
+		Message:       "Upgrading the database",
+		RetryAfterSec: 60,
+		Allow:         []string{"10.0.0.0/8"},
+		BypassHeader:  "X-Maintenance-Bypass",
+		BypassToken:   "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rw := httptest.NewRecorder()
+	if !m.blocks(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil)) {
+		t.Fatal("Request passed during maintenance")
+	}
+	var resp errorResponse
+	_ = json.NewDecoder(rw.Body).Decode(&resp)
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "60" || resp.Error != errMaintenance || resp.Message != "Upgrading the database" {
+		t.Errorf("Unexpected maintenance response %d %+v", rw.Code, resp)
+	}
+
+	allowed := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	allowed.RemoteAddr = "10.1.2.3:1234"
+	bypass := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	bypass.Header.Set("X-Maintenance-Bypass", "secret")
+	for name, r := range map[string]*http.Request{"allowlist": allowed, "header": bypass} {
+		if m.blocks(httptest.NewRecorder(), r) {
+			t.Errorf("Request from the %s was blocked", name)
+		}
+	}
+
+	m.set(maintenanceState{Enabled: false})
+	if m.blocks(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)) {
+		t.Errorf("Request blocked after maintenance ended")
+	}
+	if s := m.state(); s.Message != "Upgrading the database" || s.RetryAfter != 60 {
+		t.Errorf("Message was not kept: %+v", s)
+	}
+}
+
+func TestMaintenanceAdmin(t *testing.T) {
+	defer func(savedRoutes []*route, savedPools []*pool) { routes, pools = savedRoutes, savedPools }(routes, pools)
+	defer func(token string) { *adminToken = token }(*adminToken)
+	pools = mustBuildPools(&defaultConfig)
+	routes = mustBuildRoutes(&defaultConfig, pools)
+	*adminToken = "secret"
+	put := func(body []byte) *http.Request {
+		r := httptest.NewRequest("PUT", "/maintenance", bytes.NewReader(body))
+		r.Header.Set("Authorization", "Bearer secret")
+		return r
+	}
+
+	body, _ := json.Marshal(maintenanceUpdate{Pool: "servers", maintenanceState: maintenanceState{Enabled: true}})
+	rw := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rw, put(body))
+	if rw.Code != http.StatusOK || !pools[0].maintenance.isEnabled() {
+		t.Fatalf("Pool was not put into maintenance: %d %s", rw.Code, rw.Body)
+	}
+
+	rw = httptest.NewRecorder()
+	handleRequest(rw, httptest.NewRequest("GET", "/api/v1/some-data", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected maintenance response, got %d", rw.Code)
+	}
+
+	body, _ = json.Marshal(maintenanceUpdate{Route: "/missing"})
+	rw = httptest.NewRecorder()
+	adminHandler().ServeHTTP(rw, put(body))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Unknown route accepted: %d", rw.Code)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// counters are exposed on the admin port in the Prometheus text format.
+var (
+	countersMu sync.Mutex
+	counters   = map[string]int64{}
+)
+
+// metricKey renders a metric name with label name/value pairs.
+func metricKey(name string, labels ...string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return fmt.Sprintf("%s{%s}", name, strings.Join(pairs, ","))
+}
+
+func addCounter(delta int64, name string, labels ...string) {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	counters[metricKey(name, labels...)] += delta
+}
+
+func incCounter(name string, labels ...string) {
+	addCounter(1, name, labels...)
+}
+
+func counterValue(name string, labels ...string) int64 {
+	countersMu.Lock()
+	defer countersMu.Unlock()
+	return counters[metricKey(name, labels...)]
+}
+
+func serveMetrics(rw http.ResponseWriter, _ *http.Request) {
+	countersMu.Lock()
+	keys := make([]string, 0, len(counters))
+	for k := range counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = fmt.Sprintf("%s %d\n", k, counters[k])
+	}
+	countersMu.Unlock()
+
+	rw.Header().Set("content-type", "text/plain; version=0.0.4")
+	rw.WriteHeader(http.StatusOK)
+	for _, line := range lines {
+		_, _ = rw.Write([]byte(line))
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type mirror struct {
+	pool    *pool
+	percent float64
+}
+
+type mirrorResult struct {
+	status  int
+	latency time.Duration
+}
+
+var mirrorSlots chan struct{}
+
+func initMirroring() {
+	mirrorSlots = make(chan struct{}, *mirrorConcurrency)
+}
+
+// startMirror sends a copy of r to the shadow pool of the route in the
+// background. The returned channel receives the primary result to compare
+// with, it is nil when the request is not mirrored.
+func startMirror(rt *route, r *http.Request) chan<- mirrorResult {
+	if rt.mirror == nil || rand.Float64()*100 >= rt.mirror.percent {
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buffered, err := ioutil.ReadAll(io.LimitReader(r.Body, *mirrorMaxBody+1))
+		// The primary request still needs the whole body.
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(buffered), r.Body))
+		if err != nil || int64(len(buffered)) > *mirrorMaxBody {
+			incCounter("lb_mirror_skipped_total", "route", rt.prefix, "reason", "body")
+			return nil
+		}
+		body = buffered
+	}
+
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		incCounter("lb_mirror_skipped_total", "route", rt.prefix, "reason", "concurrency")
+		return nil
+	}
+
+	primary := make(chan mirrorResult, 1)
+	shadow := r.Clone(context.Background())
+	shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	go func() {
+		defer func() { <-mirrorSlots }()
+		result := sendMirror(rt.mirror.pool, shadow)
+		compareMirror(rt.prefix, <-primary, result)
+	}()
+	return primary
+}
+
+func sendMirror(p *pool, r *http.Request) mirrorResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	server, err := p.balance(r.RemoteAddr)
+	if err != nil {
+		return mirrorResult{}
+	}
+	start := time.Now()
+	resp, err := roundTrip(ctx, server, r)
+	if err != nil {
+		log.Printf("Mirror to %s failed: %s", server, err)
+		return mirrorResult{latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	return mirrorResult{status: resp.StatusCode, latency: time.Since(start)}
+}
+
+// compareMirror records status codes and latencies of both sides. Status 0
+// means the request failed without a response.
+func compareMirror(route string, primary, shadow mirrorResult) {
+	for side, res := range map[string]mirrorResult{"primary": primary, "shadow": shadow} {
+		incCounter("lb_mirror_responses_total", "route", route, "side", side, "code", strconv.Itoa(res.status))
+		addCounter(res.latency.Milliseconds(), "lb_mirror_latency_ms_sum", "route", route, "side", side)
+	}
+	if primary.status != shadow.status {
+		incCounter("lb_mirror_status_mismatches_total", "route", route)
+	}
+}
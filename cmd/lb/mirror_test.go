@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan string, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- string(body)
+		rw.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer shadowServer.Close()
+
+	initMirroring()
+	shadow := &pool{
+		name:       "shadow",
+		backends:   []*backend{newBackend(strings.TrimPrefix(shadowServer.URL, "http://"))},
+		minHealthy: 1,
+		active:     "shadow",
+	}
+	rt := newRoute("/mirror", nil)
+	rt.mirror = &mirror{pool: shadow, percent: 100}
+
+	r := httptest.NewRequest("POST", "/mirror", strings.NewReader("payload"))
+	primary := startMirror(rt, r)
+	if primary == nil {
+		t.Fatal("Request was not mirrored")
+	}
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != "payload" {
+		t.Errorf("Primary request body was consumed: %q", body)
+	}
+	primary <- mirrorResult{status: http.StatusOK, latency: time.Millisecond}
+
+	select {
+	case body := <-mirrored:
+		if body != "payload" {
+			t.Errorf("Unexpected mirrored body %q", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Shadow pool did not receive the request")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for counterValue("lb_mirror_status_mismatches_total", "route", "/mirror") != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Status mismatch was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirrorBodyLimit(t *testing.T) {
+	rt := newRoute("/mirror", nil)
+	rt.mirror = &mirror{pool: &pool{name: "shadow"}, percent: 100}
+
+	large := strings.Repeat("x", int(*mirrorMaxBody)+1)
+	r := httptest.NewRequest("POST", "/mirror", strings.NewReader(large))
+	if startMirror(rt, r) != nil {
+		t.Error("Request over the body limit was mirrored")
+	}
+	if body, _ := ioutil.ReadAll(r.Body); string(body) != large {
+		t.Error("Primary request body was truncated")
+	}
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	strategyHash             = "hash"
+	strategyLeastConnections = "least-connections"
+
+	healthCheckHTTP = "http"
+	healthCheckTCP  = "tcp"
+
+	// slowStartMinWeight is the share of traffic a backend gets right after
+	// it becomes healthy when the pool has a slow-start window.
+	slowStartMinWeight = 0.1
+	// loadSmoothing is the weight of the latest load report in the load
+	// factor of a backend.
+	loadSmoothing = 0.5
+
+	// zoneTag is the backend tag compared with the zone of the balancer.
+	zoneTag                  = "zone"
+	defaultLocalityThreshold = 0.5
+
+	// maxBackendWeight bounds the static weight of a backend.
+	maxBackendWeight = 1000
+)
+
+type backend struct {
+	addr string
+
+	mu      sync.Mutex
+	healthy bool
+	conns   int
+	// healthySince is when the backend last recovered, zero for backends
+	// that were healthy from the start.
+	healthySince time.Time
+	// load is the weight factor derived from the load the backend reports.
+	load float64
+	// share is the static weight of the backend relative to the others of
+	// its pool, tags describe it, e.g. its zone.
+	share    int
+	tags     map[string]string
+	draining bool
+	// registered backends joined through the registry, which alone removes
+	// them.
+	registered bool
+	// done is closed when the backend is removed from its pool.
+	done    chan struct{}
+	retired sync.Once
+}
+
+func newBackend(addr string) *backend {
+	return &backend{addr: addr, healthy: true, load: 1, share: 1, done: make(chan struct{})}
+}
+
+func (b *backend) configure(share int, tags map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if share < 1 {
+		share = 1
+	}
+	b.share, b.tags = share, tags
+}
+
+// hasTags tells whether the backend has all the tags with the same values.
+func (b *backend) hasTags(tags map[string]string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for key, value := range tags {
+		if b.tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *backend) staticWeight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.share
+}
+
+// drain stops new requests to the backend, requests in flight complete.
+func (b *backend) drain() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.draining = true
+}
+
+func (b *backend) isDraining() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.draining
+}
+
+// retire stops the health checks of a backend removed from its pool.
+func (b *backend) retire() {
+	b.retired.Do(func() { close(b.done) })
+}
+
+func (b *backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *backend) setHealthy(healthy bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if healthy && !b.healthy {
+		b.healthySince = time.Now()
+	}
+	b.healthy = healthy
+}
+
+// weight is the share of its normal traffic the backend takes: its load
+// factor, ramped linearly from slowStartMinWeight during the slow-start
+// window after the backend recovers.
+func (b *backend) weight(slowStart time.Duration, now time.Time) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if slowStart <= 0 || b.healthySince.IsZero() {
+		return b.load
+	}
+	elapsed := now.Sub(b.healthySince)
+	if elapsed >= slowStart {
+		return b.load
+	}
+	return b.load * (slowStartMinWeight + (1-slowStartMinWeight)*float64(elapsed)/float64(slowStart))
+}
+
+// reportLoad updates the load factor with a new report, smoothing it so one
+// busy moment doesn't move all the traffic away.
+func (b *backend) reportLoad(factor float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.load = loadSmoothing*factor + (1-loadSmoothing)*b.load
+}
+
+// connect and disconnect track requests and TCP connections in flight for
+// the least-connections strategy.
+func (b *backend) connect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns++
+}
+
+func (b *backend) disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.conns--
+}
+
+func (b *backend) activeConns() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.conns
+}
+
+// pool is a group of interchangeable backends. When fewer than minHealthy of
+// them are healthy, traffic goes to the first backup pool that has a healthy
+// backend.
+type pool struct {
+	name        string
+	backups     []*pool
+	minHealthy  int
+	strategy    string
+	healthCheck string
+	slowStart   time.Duration
+	discovery   *dnsDiscovery
+	// localityThreshold is the share of backends in the balancer zone that
+	// has to be healthy to keep the traffic in the zone.
+	localityThreshold float64
+	maintenance       *maintenance
+
+	backendsMu sync.RWMutex
+	backends   []*backend
+
+	mu     sync.Mutex
+	active string
+}
+
+// list returns the current backends of the pool, which change when a
+// discovery source updates them.
+func (p *pool) list() []*backend {
+	p.backendsMu.RLock()
+	defer p.backendsMu.RUnlock()
+	return append([]*backend(nil), p.backends...)
+}
+
+// setBackends replaces the backends of the pool with addrs. Backends that
+// stay keep their health and connection state, registered backends stay
+// regardless of addrs. New backends start unhealthy until a health check.
+func (p *pool) setBackends(addrs []string) (added, removed []*backend) {
+	p.backendsMu.Lock()
+	defer p.backendsMu.Unlock()
+	existing := map[string]*backend{}
+	for _, b := range p.backends {
+		existing[b.addr] = b
+	}
+	backends := make([]*backend, 0, len(addrs))
+	for _, addr := range addrs {
+		b, ok := existing[addr]
+		if ok {
+			delete(existing, addr)
+		} else {
+			b = newBackend(addr)
+			b.setHealthy(false)
+			added = append(added, b)
+		}
+		backends = append(backends, b)
+	}
+	for _, b := range p.backends {
+		if _, ok := existing[b.addr]; !ok {
+			continue
+		}
+		if b.registered {
+			backends = append(backends, b)
+		} else {
+			removed = append(removed, b)
+		}
+	}
+	p.backends = backends
+	return added, removed
+}
+
+// add puts b into the pool unless a backend with its address is there, and
+// returns the backend the pool has for the address.
+func (p *pool) add(b *backend) (*backend, bool) {
+	p.backendsMu.Lock()
+	defer p.backendsMu.Unlock()
+	for _, existing := range p.backends {
+		if existing.addr == b.addr {
+			return existing, false
+		}
+	}
+	p.backends = append(p.backends, b)
+	return b, true
+}
+
+func (p *pool) remove(b *backend) {
+	p.backendsMu.Lock()
+	defer p.backendsMu.Unlock()
+	for i, existing := range p.backends {
+		if existing == b {
+			p.backends = append(p.backends[:i:i], p.backends[i+1:]...)
+			return
+		}
+	}
+}
+
+func (p *pool) healthyBackends() []*backend {
+	healthy := []*backend{}
+	for _, b := range p.list() {
+		if b.isHealthy() && !b.isDraining() {
+			healthy = append(healthy, b)
+		}
+	}
+	return healthy
+}
+
+// serving returns the pool that currently takes the traffic of p and its
+// healthy backends.
+func (p *pool) serving() (*pool, []*backend) {
+	target, healthy := p, p.healthyBackends()
+	if len(healthy) < p.minHealthy {
+		for _, backup := range p.backups {
+			if backupHealthy := backup.healthyBackends(); len(backupHealthy) > 0 {
+				target, healthy = backup, backupHealthy
+				break
+			}
+		}
+	}
+	p.switchTo(target)
+	return target, healthy
+}
+
+func (p *pool) switchTo(target *pool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.active == target.name {
+		return
+	}
+	if target == p {
+		log.Printf("Pool %s recovered, switching back from %s", p.name, p.active)
+	} else {
+		log.Printf("Pool %s is below %d healthy backends, switching to backup %s", p.name, p.minHealthy, target.name)
+	}
+	incCounter("lb_pool_switches_total", "pool", p.name, "to", target.name)
+	p.active = target.name
+}
+
+// local narrows healthy backends to those in the zone of the balancer while
+// enough of them are healthy.
+func (p *pool) local(healthy []*backend) []*backend {
+	if *localZone == "" {
+		return healthy
+	}
+	zone := map[string]string{zoneTag: *localZone}
+	total := 0
+	for _, b := range p.list() {
+		if b.hasTags(zone) {
+			total++
+		}
+	}
+	if total == 0 {
+		return healthy
+	}
+	var local []*backend
+	for _, b := range healthy {
+		if b.hasTags(zone) {
+			local = append(local, b)
+		}
+	}
+	if len(local) == 0 || float64(len(local))/float64(total) < p.localityThreshold {
+		incCounter("lb_zone_spillover_total", "pool", p.name)
+		return healthy
+	}
+	return local
+}
+
+func tagged(healthy []*backend, tags map[string]string) []*backend {
+	var matching []*backend
+	for _, b := range healthy {
+		if b.hasTags(tags) {
+			matching = append(matching, b)
+		}
+	}
+	return matching
+}
+
+// pick chooses a backend for the client address with the strategy of the
+// pool that serves the traffic.
+func (p *pool) pick(addr string) (*backend, error) {
+	return p.pickTagged(addr, nil)
+}
+
+// pickTagged is pick among the backends with the tags, e.g. a version the
+// client asked for. Without such backends any backend is picked.
+func (p *pool) pickTagged(addr string, tags map[string]string) (*backend, error) {
+	target, healthy := p.serving()
+	if len(healthy) == 0 {
+		return nil, errors.New("No servers available")
+	}
+	if len(tags) > 0 {
+		if matching := tagged(healthy, tags); len(matching) > 0 {
+			healthy = matching
+		} else {
+			incCounter("lb_tag_misses_total", "pool", target.name)
+		}
+	}
+	healthy = target.local(healthy)
+	if target != p {
+		incCounter("lb_backup_requests_total", "pool", p.name, "backup", target.name)
+	}
+	now := time.Now()
+	if target.strategy == strategyLeastConnections {
+		var best *backend
+		var bestLoad float64
+		for _, b := range healthy {
+			load := float64(b.activeConns()+1) / (float64(b.staticWeight()) * b.weight(target.slowStart, now))
+			if best == nil || load < bestLoad {
+				best, bestLoad = b, load
+			}
+		}
+		return best, nil
+	}
+	addrHash := hashAddress(addr)
+	picked := pickWeighted(healthy, addrHash)
+	// A warming up or loaded backend keeps only the share of its clients
+	// given by its weight relative to the heaviest backend, the rest are
+	// hashed onto the backends with more room. Backends that are equally
+	// loaded keep all their clients.
+	weight, heaviest := picked.weight(target.slowStart, now), 0.0
+	for _, b := range healthy {
+		if w := b.weight(target.slowStart, now); w > heaviest {
+			heaviest = w
+		}
+	}
+	if weight < heaviest && float64(weightBucket(addr)) >= weight/heaviest*1000 {
+		var lighter []*backend
+		for _, b := range healthy {
+			if b.weight(target.slowStart, now) > weight {
+				lighter = append(lighter, b)
+			}
+		}
+		if len(lighter) > 0 {
+			return pickWeighted(lighter, addrHash), nil
+		}
+	}
+	return picked, nil
+}
+
+// pickWeighted maps the hash onto the backends laid out one after another
+// by their static weights, so hashing splits clients by weight.
+func pickWeighted(backends []*backend, hash int) *backend {
+	weights := make([]int, len(backends))
+	total := 0
+	for i, b := range backends {
+		weights[i] = b.staticWeight()
+		total += weights[i]
+	}
+	n := hash % total
+	for i, w := range weights {
+		if n < w {
+			return backends[i]
+		}
+		n -= w
+	}
+	return backends[len(backends)-1]
+}
+
+// weightBucket spreads clients evenly over 1000 buckets, the lowest of
+// which stay with a backend whose weight is lowered. The port is left out so
+// new connections of a client land in the same bucket.
+func weightBucket(addr string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(clientHost(addr)))
+	return h.Sum32() % 1000
+}
+
+func (p *pool) balance(addr string) (string, error) {
+	b, err := p.pick(addr)
+	if err != nil {
+		return "", err
+	}
+	return b.addr, nil
+}
+
+// alternate picks a random healthy backend other than primary, so hedged
+// requests spread over the pool.
+func (p *pool) alternate(primary string) (string, bool) {
+	_, healthy := p.serving()
+	var others []*backend
+	for _, b := range healthy {
+		if b.addr != primary {
+			others = append(others, b)
+		}
+	}
+	if len(others) == 0 {
+		return "", false
+	}
+	return others[rand.Intn(len(others))].addr, true
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBackupPool(t *testing.T) {
+	pools, err := buildPools(&config{
+		Pools: []poolConfig{
+			{Name: "primary", Servers: []string{"server1:8080", "server2:8080"}, Backups: []string{"maintenance"}, MinHealthy: 2},
+			{Name: "maintenance", Servers: []string{"maintenance:8080"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := pools[0]
+
+	if server, _ := primary.balance("172.19.0.1:1234"); server == "maintenance:8080" {
+		t.Errorf("Backup pool used while primary is healthy")
+	}
+
+	primary.backends[0].setHealthy(false)
+	server, err := primary.balance("172.19.0.1:1234")
+	if err != nil || server != "maintenance:8080" {
+		t.Errorf("Expected backup server, got %s (%v)", server, err)
+	}
+	if n := counterValue("lb_pool_switches_total", "pool", "primary", "to", "maintenance"); n != 1 {
+		t.Errorf("Unexpected switch count: %d", n)
+	}
+
+	pools[1].backends[0].setHealthy(false)
+	if server, _ := primary.balance("172.19.0.1:1234"); server != "server2:8080" {
+		t.Errorf("Expected remaining primary server when backup is down, got %s", server)
+	}
+}
+
+func TestBuildPoolsValidation(t *testing.T) {
+	_, err := buildPools(&config{
+		Pools: []poolConfig{
+			{Name: "primary", Servers: []string{"server1:8080"}, Backups: []string{"missing"}},
+		},
+	})
+	if err == nil {
+		t.Error("Unknown backup pool accepted")
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	b := newBackend("server1:8080")
+	now := time.Now()
+	if w := b.weight(time.Minute, now); w != 1 {
+		t.Errorf("Initially healthy backend is ramping: %f", w)
+	}
+	b.setHealthy(false)
+	b.setHealthy(true)
+	if w := b.weight(time.Minute, b.healthySince); w != slowStartMinWeight {
+		t.Errorf("Unexpected weight right after recovery: %f", w)
+	}
+	if w := b.weight(time.Minute, b.healthySince.Add(30*time.Second)); w < 0.54 || w > 0.56 {
+		t.Errorf("Unexpected weight in the middle of slow start: %f", w)
+	}
+	if w := b.weight(time.Minute, b.healthySince.Add(time.Minute)); w != 1 {
+		t.Errorf("Unexpected weight after slow start: %f", w)
+	}
+
+	p := &pool{
+		name:       "servers",
+		backends:   []*backend{newBackend("server1:8080"), newBackend("server2:8080")},
+		minHealthy: 1,
+		strategy:   strategyHash,
+		slowStart:  time.Hour,
+		active:     "servers",
+	}
+	p.backends[1].setHealthy(false)
+	p.backends[1].setHealthy(true)
+	recovered := 0
+	for i := 0; i < 1000; i++ {
+		if server, _ := p.balance(fmt.Sprintf("10.0.%d.%d:1234", i/256, i%256)); server == "server2:8080" {
+			recovered++
+		}
+	}
+	if recovered == 0 || recovered > 150 {
+		t.Errorf("Recovered backend got %d of 1000 clients", recovered)
+	}
+	for i := 0; i < 100; i++ {
+		first, _ := p.balance(fmt.Sprintf("10.1.0.%d:1111", i))
+		second, _ := p.balance(fmt.Sprintf("10.1.0.%d:2222", i))
+		if first != second {
+			t.Fatalf("Client 10.1.0.%d moved from %s to %s on a new connection", i, first, second)
+		}
+	}
+
+	p.strategy = strategyLeastConnections
+	p.backends[0].connect()
+	if server, _ := p.balance(""); server != "server1:8080" {
+		t.Errorf("Least connections ignored slow start, picked %s", server)
+	}
+}
+
+func TestZoneAndTags(t *testing.T) {
+	defer func(zone string) { *localZone = zone }(*localZone)
+	*localZone = "a"
+	pools, err := buildPools(&config{
+		Pools: []poolConfig{{
+			Name:     "servers",
+			Strategy: strategyLeastConnections,
+			Backends: []serverConfig{
+				{Address: "server1:8080", Tags: map[string]string{"zone": "a", "version": "v1"}},
+				{Address: "server2:8080", Tags: map[string]string{"zone": "a", "version": "v1"}},
+				{Address: "server3:8080", Tags: map[string]string{"zone": "b", "version": "v2"}},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := pools[0]
+	for i := 0; i < 3; i++ {
+		b, _ := p.pick("")
+		if b.addr == "server3:8080" {
+			t.Fatal("Backend in another zone picked while the local zone is healthy")
+		}
+		b.connect()
+	}
+
+	p.backends[0].setHealthy(false)
+	if b, _ := p.pick(""); b.addr != "server2:8080" {
+		t.Errorf("Expected local backend at the threshold, got %s", b.addr)
+	}
+	p.backends[1].setHealthy(false)
+	if b, _ := p.pick(""); b.addr != "server3:8080" {
+		t.Errorf("Expected spill over to another zone, got %s", b.addr)
+	}
+	p.backends[0].setHealthy(true)
+	p.backends[1].setHealthy(true)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Backend-Tags", "version=v2")
+	if b, _ := p.pickTagged("", requestTags(r)); b.addr != "server3:8080" {
+		t.Errorf("Expected backend with the requested version, got %s", b.addr)
+	}
+	if b, _ := p.pickTagged("", map[string]string{"version": "v3"}); b == nil {
+		t.Errorf("No backend picked for an unknown version")
+	}
+}
+
+func TestPickWeighted(t *testing.T) {
+	light, heavy := newBackend("server1:8080"), newBackend("server2:8080")
+	heavy.configure(maxBackendWeight, nil)
+	picked := map[*backend]int{}
+	for hash := 0; hash < 2*(maxBackendWeight+1); hash++ {
+		picked[pickWeighted([]*backend{light, heavy}, hash)]++
+	}
+	if picked[light] != 2 || picked[heavy] != 2*maxBackendWeight {
+		t.Errorf("Clients were not split by weight: %d and %d", picked[light], picked[heavy])
+	}
+}
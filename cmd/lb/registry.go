@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRegistrationTTL = 15 * time.Second
+	registrySweepInterval  = time.Second
+	drainCheckInterval     = 100 * time.Millisecond
+)
+
+var (
+	errUnknownRegistration = errors.New("backend is not registered")
+	errStaticBackend       = errors.New("backend is configured statically")
+	errDraining            = errors.New("backend is draining")
+)
+
+// registration is what a backend sends to the admin API on startup and then
+// periodically as a heartbeat.
+type registration struct {
+	Pool    string            `json:"pool"`
+	Address string            `json:"address"`
+	Weight  int               `json:"weight,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	TTLSec  int               `json:"ttlSec,omitempty"`
+}
+
+type registeredBackend struct {
+	registration
+	pool    *pool
+	backend *backend
+	expires time.Time
+}
+
+// registry keeps the backends that registered themselves. A backend whose
+// heartbeats stop for longer than its TTL is removed, a deregistered one is
+// drained first.
+type registry struct {
+	drainTimeout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*registeredBackend
+}
+
+var backendRegistry = newRegistry(30 * time.Second)
+
+func newRegistry(drainTimeout time.Duration) *registry {
+	return &registry{drainTimeout: drainTimeout, entries: map[string]*registeredBackend{}}
+}
+
+func registryKey(pool, addr string) string {
+	return pool + "/" + addr
+}
+
+// register adds the backend to its pool or, for a registered backend,
+// refreshes its TTL, weight and tags.
+func (r *registry) register(reg registration, now time.Time) error {
+	p := poolByName(pools, reg.Pool)
+	if p == nil {
+		return fmt.Errorf("unknown pool %q", reg.Pool)
+	}
+	if err := validBackendAddr(reg.Address); err != nil {
+		return err
+	}
+	if reg.Weight < 0 || reg.Weight > maxBackendWeight {
+		return fmt.Errorf("weight is not between 0 and %d", maxBackendWeight)
+	}
+	ttl := time.Duration(reg.TTLSec) * time.Second
+	if ttl <= 0 {
+		ttl = defaultRegistrationTTL
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := registryKey(reg.Pool, reg.Address)
+	entry, ok := r.entries[key]
+	if !ok {
+		// A registered backend gets traffic only after it passes a health
+		// check.
+		b := newBackend(reg.Address)
+		b.setHealthy(false)
+		b.registered = true
+		if _, added := p.add(b); !added {
+			return errStaticBackend
+		}
+		log.Printf("Backend %s registered in pool %s", reg.Address, p.name)
+		incCounter("lb_registrations_total", "pool", p.name)
+		go checkNewBackend(p, b)
+		entry = &registeredBackend{pool: p, backend: b}
+		r.entries[key] = entry
+	} else if entry.backend.isDraining() {
+		return errDraining
+	}
+	entry.registration = reg
+	entry.expires = now.Add(ttl)
+	entry.backend.configure(reg.Weight, reg.Tags)
+	return nil
+}
+
+// deregister stops new requests to the backend and removes it once its
+// requests in flight complete or the drain timeout passes.
+func (r *registry) deregister(pool, addr string) error {
+	r.mu.Lock()
+	entry, ok := r.entries[registryKey(pool, addr)]
+	r.mu.Unlock()
+	if !ok {
+		return errUnknownRegistration
+	}
+	if entry.backend.isDraining() {
+		return nil
+	}
+	log.Printf("Backend %s deregistered from pool %s, draining", addr, pool)
+	entry.backend.drain()
+	go func() {
+		deadline := time.Now().Add(r.drainTimeout)
+		for entry.backend.activeConns() > 0 && time.Now().Before(deadline) {
+			time.Sleep(drainCheckInterval)
+		}
+		r.unregister(entry)
+	}()
+	return nil
+}
+
+func (r *registry) unregister(entry *registeredBackend) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.entries, registryKey(entry.Pool, entry.Address))
+	entry.pool.remove(entry.backend)
+	entry.backend.retire()
+}
+
+// expire removes the backends whose TTL passed without a heartbeat.
+func (r *registry) expire(now time.Time) {
+	r.mu.Lock()
+	var expired []*registeredBackend
+	for _, entry := range r.entries {
+		if now.After(entry.expires) && !entry.backend.isDraining() {
+			expired = append(expired, entry)
+		}
+	}
+	r.mu.Unlock()
+	for _, entry := range expired {
+		log.Printf("Backend %s in pool %s missed its heartbeats, removing", entry.Address, entry.Pool)
+		incCounter("lb_registrations_expired_total", "pool", entry.Pool)
+		r.unregister(entry)
+	}
+}
+
+func (r *registry) list() []registration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := []registration{}
+	for _, entry := range r.entries {
+		list = append(list, entry.registration)
+	}
+	return list
+}
+
+func (r *registry) run() {
+	for now := range time.Tick(registrySweepInterval) {
+		r.expire(now)
+	}
+}
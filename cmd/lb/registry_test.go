@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	defer func(saved []*pool) { pools = saved }(pools)
+	p := &pool{name: "servers", backends: []*backend{newBackend("server1:8080")}, minHealthy: 1, active: "servers"}
+	pools = []*pool{p}
+	r := newRegistry(time.Second)
+	now := time.Now()
+
+	if err := r.register(registration{Pool: "servers", Address: "server1:8080"}, now); !errors.Is(err, errStaticBackend) {
+		t.Errorf("Static backend was taken over: %v", err)
+	}
+	if err := r.register(registration{Pool: "other", Address: "server4:8080"}, now); err == nil {
+		t.Errorf("Unknown pool accepted")
+	}
+	if err := r.register(registration{Pool: "servers", Address: "server4:8080", Weight: 1000000}, now); err == nil {
+		t.Errorf("Weight over the limit accepted")
+	}
+	reg := registration{Pool: "servers", Address: "server4:8080", Weight: 3, Tags: map[string]string{"zone": "a"}, TTLSec: 10}
+	if err := r.register(reg, now); err != nil {
+		t.Fatal(err)
+	}
+	if list := addrs(p.list()); len(list) != 2 || list[1] != "server4:8080" {
+		t.Fatalf("Registered backend was not added: %v", list)
+	}
+	registered := p.list()[1]
+	if registered.staticWeight() != 3 || registered.tags["zone"] != "a" {
+		t.Errorf("Weight and tags were not applied")
+	}
+	if registered.isHealthy() {
+		t.Errorf("Registered backend is healthy before a health check")
+	}
+	applyBackends(p, []string{"server1:8080", "server2:8080"})
+	if list := addrs(p.list()); len(list) != 3 || list[2] != "server4:8080" {
+		t.Errorf("Discovery update removed the registered backend: %v", list)
+	}
+	applyBackends(p, []string{"server1:8080"})
+
+	r.expire(now.Add(5 * time.Second))
+	if err := r.register(reg, now.Add(5*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r.expire(now.Add(12 * time.Second))
+	if len(p.list()) != 2 {
+		t.Errorf("Backend removed despite a heartbeat")
+	}
+	r.expire(now.Add(16 * time.Second))
+	if list := addrs(p.list()); len(list) != 1 {
+		t.Errorf("Backend was kept after its TTL: %v", list)
+	}
+
+	backendServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+	defer backendServer.Close()
+	live := registration{Pool: "servers", Address: strings.TrimPrefix(backendServer.URL, "http://")}
+	if err := r.register(live, now); err != nil {
+		t.Fatal(err)
+	}
+	draining := p.list()[1]
+	for i := 0; !draining.isHealthy(); i++ {
+		if i == 100 {
+			t.Fatal("Registered backend did not pass its health check")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// With the static backend down only the registered one can be picked.
+	p.list()[0].setHealthy(false)
+	if b, _ := p.pick("172.19.0.1:1234"); b != draining {
+		t.Fatal("Registered backend was not picked")
+	}
+	draining.connect()
+	if err := r.deregister("servers", live.Address); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if b, _ := p.pick("172.19.0.1:1234"); b == draining {
+			t.Fatal("Draining backend got a new request")
+		}
+	}
+	time.Sleep(3 * drainCheckInterval)
+	if len(p.list()) != 2 {
+		t.Errorf("Backend removed before its requests completed")
+	}
+	draining.disconnect()
+	time.Sleep(3 * drainCheckInterval)
+	if len(p.list()) != 1 {
+		t.Errorf("Drained backend was not removed")
+	}
+	if err := r.deregister("servers", live.Address); !errors.Is(err, errUnknownRegistration) {
+		t.Errorf("Unexpected error for an unknown backend: %v", err)
+	}
+}
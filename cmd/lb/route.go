@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type split struct {
+	pool   *pool
+	weight int
+}
+
+// route sends requests with a path prefix to one or several pools. Traffic is
+// split between the pools by weight, which can be changed at runtime.
+type route struct {
+	prefix string
+
+	mu     sync.Mutex
+	splits []*split
+	acl    *ipACL
+
+	stickyKind     string
+	stickyName     string
+	overrideHeader string
+	overrideCookie string
+
+	mirror          *mirror
+	errorPages      map[int]*template.Template
+	requestHeaders  []*headerRule
+	responseHeaders []*headerRule
+	auth            *authenticator
+	maintenance     *maintenance
+}
+
+func newRoute(prefix string, splits []*split) *route {
+	m, _ := newMaintenance(nil)
+	return &route{prefix: prefix, splits: splits, maintenance: m}
+}
+
+func (rt *route) setSticky(spec string) error {
+	if spec == "" || spec == "ip" {
+		rt.stickyKind = spec
+		return nil
+	}
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != "header" && parts[0] != "cookie") {
+		return fmt.Errorf("invalid sticky key %q", spec)
+	}
+	rt.stickyKind, rt.stickyName = parts[0], parts[1]
+	return nil
+}
+
+func (rt *route) clientKey(r *http.Request) string {
+	switch rt.stickyKind {
+	case "ip":
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	case "header":
+		return r.Header.Get(rt.stickyName)
+	case "cookie":
+		if c, err := r.Cookie(rt.stickyName); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+func (rt *route) override(r *http.Request) string {
+	if rt.overrideHeader != "" {
+		if name := r.Header.Get(rt.overrideHeader); name != "" {
+			return name
+		}
+	}
+	if rt.overrideCookie != "" {
+		if c, err := r.Cookie(rt.overrideCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// choosePool picks the pool for the request: an override from a tester wins,
+// then the client key is hashed onto the weights so a client consistently
+// lands on the same side of the split.
+func (rt *route) choosePool(r *http.Request) *pool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if name := rt.override(r); name != "" {
+		for _, s := range rt.splits {
+			if s.pool.name == name {
+				return s.pool
+			}
+		}
+	}
+
+	total := 0
+	for _, s := range rt.splits {
+		total += s.weight
+	}
+	if total == 0 {
+		return rt.splits[0].pool
+	}
+
+	var n int
+	if key := rt.clientKey(r); key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		n = int(h.Sum32() % uint32(total))
+	} else {
+		n = rand.Intn(total)
+	}
+	for _, s := range rt.splits {
+		if n < s.weight {
+			return s.pool
+		}
+		n -= s.weight
+	}
+	return rt.splits[len(rt.splits)-1].pool
+}
+
+func (rt *route) weights() map[string]int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	weights := map[string]int{}
+	for _, s := range rt.splits {
+		weights[s.pool.name] = s.weight
+	}
+	return weights
+}
+
+func (rt *route) setWeights(weights map[string]int) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for name, weight := range weights {
+		if weight < 0 {
+			return fmt.Errorf("negative weight for pool %q", name)
+		}
+		found := false
+		for _, s := range rt.splits {
+			found = found || s.pool.name == name
+		}
+		if !found {
+			return fmt.Errorf("pool %q is not part of route %q", name, rt.prefix)
+		}
+	}
+	for _, s := range rt.splits {
+		if weight, ok := weights[s.pool.name]; ok {
+			s.weight = weight
+		}
+	}
+	return nil
+}
+
+func (rt *route) setACL(acl *ipACL) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.acl = acl
+}
+
+func (rt *route) allows(r *http.Request) bool {
+	rt.mu.Lock()
+	acl := rt.acl
+	rt.mu.Unlock()
+	return acl.allows(net.ParseIP(clientIP(r)))
+}
+
+func routeByPrefix(prefix string) *route {
+	for _, rt := range routes {
+		if rt.prefix == prefix {
+			return rt
+		}
+	}
+	return nil
+}
+
+// matchRoute returns the route with the longest prefix of path.
+func matchRoute(routes []*route, path string) *route {
+	var best *route
+	for _, rt := range routes {
+		if strings.HasPrefix(path, rt.prefix) && (best == nil || len(rt.prefix) > len(best.prefix)) {
+			best = rt
+		}
+	}
+	return best
+}
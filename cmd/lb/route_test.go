@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func canaryRoutes(t *testing.T) []*route {
+	c := &config{
+		Pools: []poolConfig{
+			{Name: "stable", Servers: []string{"server1:8080"}},
+			{Name: "canary", Servers: []string{"server2:8080"}},
+		},
+		Routes: []routeConfig{
+			{Prefix: "/", Pool: "stable"},
+			{
+				Prefix:         "/api/",
+				Split:          []splitConfig{{Pool: "stable", Weight: 95}, {Pool: "canary", Weight: 5}},
+				Sticky:         "header:X-User",
+				OverrideHeader: "X-Pool",
+			},
+		},
+	}
+	pools, err := buildPools(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes, err := buildRoutes(c, pools)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return routes
+}
+
+func TestRouteSplit(t *testing.T) {
+	routes := canaryRoutes(t)
+	if rt := matchRoute(routes, "/report"); rt.prefix != "/" {
+		t.Errorf("Unexpected route %s", rt.prefix)
+	}
+	rt := matchRoute(routes, "/api/v1/some-data")
+	if rt.prefix != "/api/" {
+		t.Fatalf("Unexpected route %s", rt.prefix)
+	}
+
+	canary := 0
+	for i := 1; i <= 1000; i++ {
+		r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		r.Header.Set("X-User", strings.Repeat("u", i))
+		first := rt.choosePool(r)
+		if second := rt.choosePool(r); second != first {
+			t.Fatalf("Client switched between %s and %s", first.name, second.name)
+		}
+		if first.name == "canary" {
+			canary++
+		}
+	}
+	if canary < 20 || canary > 80 {
+		t.Errorf("Expected about 5%% of clients on canary, got %d of 1000", canary)
+	}
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.Header.Set("X-Pool", "canary")
+	if p := rt.choosePool(r); p.name != "canary" {
+		t.Errorf("Override header ignored, got %s", p.name)
+	}
+}
+
+func TestRouteSetWeights(t *testing.T) {
+	rt := matchRoute(canaryRoutes(t), "/api/")
+	if err := rt.setWeights(map[string]int{"stable": 0, "canary": 100}); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	if p := rt.choosePool(r); p.name != "canary" {
+		t.Errorf("Expected all traffic on canary, got %s", p.name)
+	}
+	if err := rt.setWeights(map[string]int{"missing": 1}); err == nil {
+		t.Error("Weight for unknown pool accepted")
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	defer func(token string) { *adminToken = token }(*adminToken)
+	defer func(saved []*route) { routes = saved }(routes)
+	routes = canaryRoutes(t)
+	setWeights := func(token string) int {
+		r := httptest.NewRequest("PUT", "/routes", strings.NewReader(`{"prefix": "/api/", "weights": {"stable": 0, "canary": 100}}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		adminHandler().ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	*adminToken = ""
+	if code := setWeights("anything"); code != http.StatusForbidden {
+		t.Errorf("Admin API without a token configured answered %d", code)
+	}
+	*adminToken = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if code := setWeights(token); code != http.StatusUnauthorized {
+			t.Errorf("Token %q was accepted with %d", token, code)
+		}
+	}
+	if code := setWeights("secret"); code != http.StatusOK {
+		t.Errorf("Valid token was rejected with %d", code)
+	}
+	rw := httptest.NewRecorder()
+	adminHandler().ServeHTTP(rw, httptest.NewRequest("GET", "/metrics", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Metrics require the admin token: %d", rw.Code)
+	}
+}
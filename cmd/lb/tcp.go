@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/proxyproto"
+)
+
+const (
+	defaultTCPIdleTimeout = 5 * time.Minute
+	proxyHeaderTimeout    = 5 * time.Second
+)
+
+// tcpProxy is a layer-4 frontend. Every accepted connection is spliced to a
+// backend of the pool chosen with the pool strategy.
+type tcpProxy struct {
+	port        int
+	pool        *pool
+	idleTimeout time.Duration
+	slots       chan struct{}
+	acceptProxy bool
+	sendProxy   int
+}
+
+func newTCPProxy(port int, p *pool, idleTimeout time.Duration, maxConns int) *tcpProxy {
+	t := &tcpProxy{port: port, pool: p, idleTimeout: idleTimeout}
+	if maxConns > 0 {
+		t.slots = make(chan struct{}, maxConns)
+	}
+	return t
+}
+
+func (t *tcpProxy) Start() {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", t.port))
+	if err != nil {
+		log.Fatalf("TCP listener on port %d failed: %s", t.port, err)
+	}
+	t.serve(l)
+}
+
+func (t *tcpProxy) serve(l net.Listener) {
+	if t.acceptProxy {
+		l = acceptProxy(l)
+	}
+	log.Printf("Starting TCP proxy on %s to pool %s", l.Addr(), t.pool.name)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("TCP listener %s finished: %s", l.Addr(), err)
+				return
+			}
+			go t.handle(conn)
+		}
+	}()
+}
+
+func (t *tcpProxy) label() string {
+	return strconv.Itoa(t.port)
+}
+
+func (t *tcpProxy) handle(client net.Conn) {
+	defer client.Close()
+	if t.slots != nil {
+		select {
+		case t.slots <- struct{}{}:
+			defer func() { <-t.slots }()
+		default:
+			incCounter("lb_tcp_rejected_total", "listener", t.label(), "reason", "limit")
+			return
+		}
+	}
+
+	if t.pool.maintenance.isEnabled() {
+		incCounter("lb_tcp_rejected_total", "listener", t.label(), "reason", "maintenance")
+		return
+	}
+	b, err := t.pool.pick(client.RemoteAddr().String())
+	if err != nil {
+		incCounter("lb_tcp_rejected_total", "listener", t.label(), "reason", "unavailable")
+		return
+	}
+	network, address := dialAddress(b.addr)
+	upstream, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		log.Printf("Failed to connect to %s: %s", b.addr, err)
+		incCounter("lb_tcp_rejected_total", "listener", t.label(), "reason", "connect")
+		return
+	}
+	defer upstream.Close()
+	if t.sendProxy != 0 {
+		if err := proxyproto.WriteHeader(upstream, t.sendProxy, client.RemoteAddr(), client.LocalAddr()); err != nil {
+			log.Printf("Failed to send PROXY header to %s: %s", b.addr, err)
+			return
+		}
+	}
+
+	b.connect()
+	defer b.disconnect()
+	incCounter("lb_tcp_connections_total", "listener", t.label(), "backend", b.addr)
+
+	touch := func() {
+		deadline := time.Now().Add(t.idleTimeout)
+		_ = client.SetDeadline(deadline)
+		_ = upstream.SetDeadline(deadline)
+	}
+	touch()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		n := splice(upstream, client, touch)
+		addCounter(n, "lb_tcp_bytes_total", "listener", t.label(), "direction", "in")
+	}()
+	go func() {
+		defer wg.Done()
+		n := splice(client, upstream, touch)
+		addCounter(n, "lb_tcp_bytes_total", "listener", t.label(), "direction", "out")
+	}()
+	wg.Wait()
+}
+
+// splice copies src to dst until EOF, then half-closes dst so the peer sees
+// the end of stream. Any other error, including the idle timeout, closes both
+// connections.
+func splice(dst, src net.Conn, touch func()) int64 {
+	buf := make([]byte, 32<<10)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			touch()
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				src.Close()
+				dst.Close()
+				return total
+			}
+			total += int64(n)
+		}
+		if err == io.EOF {
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				_ = cw.CloseWrite()
+			} else {
+				dst.Close()
+			}
+			return total
+		}
+		if err != nil {
+			src.Close()
+			dst.Close()
+			return total
+		}
+	}
+}
+
+func acceptProxy(l net.Listener) net.Listener {
+	return &proxyproto.Listener{Listener: l, Timeout: proxyHeaderTimeout}
+}
+
+func tcpHealth(dst string) bool {
+	network, address := dialAddress(dst)
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
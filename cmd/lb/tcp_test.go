@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTCPProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	p := &pool{
+		name:       "echo",
+		backends:   []*backend{newBackend(echo.Addr().String())},
+		minHealthy: 1,
+		strategy:   strategyLeastConnections,
+		active:     "echo",
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	proxy := newTCPProxy(0, p, time.Second, 1)
+	proxy.serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Errorf("Unexpected echo %q (%v)", line, err)
+	}
+	if n := p.backends[0].activeConns(); n != 1 {
+		t.Errorf("Expected 1 active connection, got %d", n)
+	}
+
+	// The second connection is over the limit and gets closed right away.
+	second, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected connection over the limit to be closed, got %v", err)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	p := &pool{
+		name:       "test",
+		backends:   []*backend{newBackend("server1:8080"), newBackend("server2:8080")},
+		minHealthy: 1,
+		strategy:   strategyLeastConnections,
+		active:     "test",
+	}
+	p.backends[0].connect()
+	if b, _ := p.pick("172.19.0.1:1234"); b.addr != "server2:8080" {
+		t.Errorf("Expected least loaded backend, got %s", b.addr)
+	}
+}
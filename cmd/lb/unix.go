@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// unixScheme prefixes backend addresses of unix domain sockets, e.g.
+// unix:///run/server.sock.
+const unixScheme = "unix://"
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixScheme)
+}
+
+// dialAddress returns the network and address to connect to a backend.
+func dialAddress(addr string) (string, string) {
+	if isUnixAddr(addr) {
+		return "unix", strings.TrimPrefix(addr, unixScheme)
+	}
+	return "tcp", addr
+}
+
+// unixHosts maps the host names that stand for sockets in request URLs back
+// to the socket paths.
+var unixHosts sync.Map
+
+// urlHost is the host used in requests to a backend. Every socket gets its
+// own name so the transport keeps separate connections per socket.
+func urlHost(addr string) string {
+	if !isUnixAddr(addr) {
+		return addr
+	}
+	h := fnv.New64a()
+	h.Write([]byte(addr))
+	host := fmt.Sprintf("unix-%016x.sock", h.Sum64())
+	unixHosts.Store(host, strings.TrimPrefix(addr, unixScheme))
+	return host
+}
+
+func dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if path, ok := unixHosts.Load(host); ok {
+			return d.DialContext(ctx, "unix", path.(string))
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// backendClient is used for all requests to backends, including health
+// checks.
+var backendClient = newBackendClient()
+
+func newBackendClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialBackend
+	return &http.Client{Transport: transport}
+}
+
+// validBackendAddr accepts host:port and unix:///path addresses.
+func validBackendAddr(addr string) error {
+	if isUnixAddr(addr) {
+		if !strings.HasPrefix(strings.TrimPrefix(addr, unixScheme), "/") {
+			return fmt.Errorf("socket path of %q is not absolute", addr)
+		}
+		return nil
+	}
+	_, _, err := net.SplitHostPort(addr)
+	return err
+}
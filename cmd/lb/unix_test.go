@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnixBackend(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		_, _ = rw.Write([]byte("from " + r.URL.Path))
+	})}
+	go server.Serve(l)
+	defer server.Close()
+
+	dst := "unix://" + path
+	if err := validBackendAddr(dst); err != nil {
+		t.Fatal(err)
+	}
+	if healthy, _ := health(dst); !healthy {
+		t.Errorf("Unix socket backend is not healthy")
+	}
+	if !tcpHealth(dst) {
+		t.Errorf("Unix socket backend failed the connect check")
+	}
+	rw := httptest.NewRecorder()
+	if err := forward(dst, rw, httptest.NewRequest("GET", "/api/v1/some-data", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if body := rw.Body.String(); body != "from /api/v1/some-data" {
+		t.Errorf("Unexpected response %q", body)
+	}
+}
+
+func TestHashAddressPeers(t *testing.T) {
+	for _, addr := range []string{"@", "", "[::1]:1234", "/run/lb.sock"} {
+		if hashAddress(addr) < 0 {
+			t.Errorf("Negative hash of %q", addr)
+		}
+	}
+	if hashAddress("[2001:db8::1]:1111") != hashAddress("[2001:db8::1]:2222") {
+		t.Errorf("Hash of an IPv6 client depends on its port")
+	}
+	if hashAddress("[2001:db8::1]:1111") == hashAddress("[2001:db8::2]:1111") {
+		t.Errorf("IPv6 clients share a hash")
+	}
+	if err := validBackendAddr("unix://run/server.sock"); err == nil {
+		t.Errorf("Relative socket path accepted")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// loadTracker counts requests in flight and reports them on /health so the
+// balancer can send less traffic to a busy server. Requests over capacity
+// are reported as queued.
+type loadTracker struct {
+	capacity int
+	inFlight int64
+}
+
+type loadReport struct {
+	InFlight int `json:"inflight"`
+	Queue    int `json:"queue"`
+	Capacity int `json:"capacity"`
+}
+
+func (l *loadTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			atomic.AddInt64(&l.inFlight, 1)
+			defer atomic.AddInt64(&l.inFlight, -1)
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
+
+func (l *loadTracker) current() loadReport {
+	report := loadReport{InFlight: int(atomic.LoadInt64(&l.inFlight)), Capacity: l.capacity}
+	if report.InFlight > l.capacity {
+		report.Queue = report.InFlight - l.capacity
+		report.InFlight = l.capacity
+	}
+	return report
+}
+
+// report writes the load to the X-Backend-Load header, and as the body for
+// clients that accept JSON.
+func (l *loadTracker) report(rw http.ResponseWriter, r *http.Request) {
+	report := l.current()
+	rw.Header().Set("X-Backend-Load", fmt.Sprintf("inflight=%d, queue=%d, capacity=%d", report.InFlight, report.Queue, report.Capacity))
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		rw.Header().Set("content-type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(rw).Encode(report)
+		return
+	}
+	rw.Header().Set("content-type", "text/plain")
+	rw.WriteHeader(http.StatusOK)
+	_, _ = rw.Write([]byte("OK"))
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoadReport(t *testing.T) {
+	l := &loadTracker{capacity: 2}
+	release := make(chan struct{})
+	started := make(chan struct{}, 3)
+	h := l.track(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			l.report(rw, r)
+			return
+		}
+		started <- struct{}{}
+		<-release
+	}))
+	for i := 0; i < 3; i++ {
+		go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/v1/some-data", nil))
+		<-started
+	}
+
+	r := httptest.NewRequest("GET", "/health", nil)
+	r.Header.Set("Accept", "application/json")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, r)
+	close(release)
+
+	if header := rw.Header().Get("X-Backend-Load"); header != "inflight=2, queue=1, capacity=2" {
+		t.Errorf("Unexpected load header %q", header)
+	}
+	var report loadReport
+	if err := json.NewDecoder(rw.Body).Decode(&report); err != nil || report != (loadReport{InFlight: 2, Queue: 1, Capacity: 2}) {
+		t.Errorf("Unexpected load body %+v (%v)", report, err)
+	}
+}
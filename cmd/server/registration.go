@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// registration is sent to the balancer admin API to join a pool and, again,
+// as a heartbeat.
+type registration struct {
+	Pool    string            `json:"pool"`
+	Address string            `json:"address"`
+	Weight  int               `json:"weight,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	TTLSec  int               `json:"ttlSec,omitempty"`
+}
+
+type registrar struct {
+	url       string
+	token     string
+	reg       registration
+	heartbeat time.Duration
+	client    *http.Client
+	stop      chan struct{}
+}
+
+func newRegistrar(balancer string, reg registration, token string, heartbeat time.Duration) *registrar {
+	return &registrar{
+		url:       strings.TrimSuffix(balancer, "/") + "/registry",
+		token:     token,
+		reg:       reg,
+		heartbeat: heartbeat,
+		client:    &http.Client{Timeout: heartbeat},
+		stop:      make(chan struct{}),
+	}
+}
+
+// parseTags reads tags given as "zone=a,rack=1".
+func parseTags(s string) map[string]string {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && kv[0] != "" {
+			tags[kv[0]] = kv[1]
+		}
+	}
+	return tags
+}
+
+func (r *registrar) register() error {
+	body, err := json.Marshal(r.reg)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("content-type", "application/json")
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("balancer responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (r *registrar) do(req *http.Request) (*http.Response, error) {
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+	return r.client.Do(req)
+}
+
+// start registers the server and keeps sending heartbeats until deregister.
+func (r *registrar) start() {
+	if err := r.register(); err != nil {
+		log.Printf("Failed to register with the balancer: %s", err)
+	} else {
+		log.Printf("Registered as %s in pool %s", r.reg.Address, r.reg.Pool)
+	}
+	go func() {
+		ticker := time.NewTicker(r.heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if err := r.register(); err != nil {
+					log.Printf("Heartbeat to the balancer failed: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// deregister stops the heartbeats and asks the balancer to drain the server.
+func (r *registrar) deregister() error {
+	close(r.stop)
+	q := url.Values{"pool": {r.reg.Pool}, "address": {r.reg.Address}}
+	req, err := http.NewRequest(http.MethodDelete, r.url+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("balancer responded with %s", resp.Status)
+	}
+	return nil
+}
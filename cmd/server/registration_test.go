@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRegistrar(t *testing.T) {
+	registrations := make(chan registration, 10)
+	deregistered := make(chan string, 1)
+	balancer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			var reg registration
+			_ = json.NewDecoder(r.Body).Decode(&reg)
+			registrations <- reg
+			rw.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			deregistered <- r.URL.Query().Get("address")
+			rw.WriteHeader(http.StatusAccepted)
+		}
+	}))
+	defer balancer.Close()
+
+	reg := registration{Pool: "servers", Address: "server4:8080", Weight: 2, Tags: parseTags("zone=a, rack=1"), TTLSec: 3}
+	r := newRegistrar(balancer.URL, reg, "secret", 20*time.Millisecond)
+	r.start()
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-registrations:
+			if !reflect.DeepEqual(got, reg) {
+				t.Errorf("Unexpected registration %+v", got)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No registration or heartbeat sent")
+		}
+	}
+	if err := r.deregister(); err != nil {
+		t.Fatal(err)
+	}
+	if addr := <-deregistered; addr != "server4:8080" {
+		t.Errorf("Unexpected deregistered address %s", addr)
+	}
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"encoding/json"
-	"log"
 	"net/http"
+
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
 )
 
 const reportMaxLen = 100
@@ -13,7 +14,7 @@ type Report map[string][]string
 func (r Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
 	counter := req.Header.Get("lb-req-cnt")
-	log.Printf("GET some-data from [%s] request [%s]", author, counter)
+	tracing.Logf(req.Context(), "GET some-data from [%s] request [%s]", author, counter)
 
 	if len(author) > 0 {
 		list := r[author]
@@ -13,12 +13,27 @@ import (
 
 	"github.com/MaryLynJuana/KPI_Load_Balancer/httptools"
 	"github.com/MaryLynJuana/KPI_Load_Balancer/signal"
+	"github.com/MaryLynJuana/KPI_Load_Balancer/tracing"
 )
 
 var port = flag.Int("port", 8080, "server port")
+var socket = flag.String("socket", "", "unix socket to serve on in addition to the port")
 
 var db = flag.String("db", "http://database:8079/db/", "database url")
 
+var spansFile = flag.String("spans-file", "", "file to export trace spans to as JSON lines")
+var otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP endpoint to export trace spans to")
+var register = flag.String("register", "", "balancer admin URL to register with, empty to disable")
+var adminToken = flag.String("admin-token", "", "bearer token of the balancer admin API")
+var advertise = flag.String("advertise", "", "address the balancer reaches this server at, defaults to hostname:port")
+var poolName = flag.String("pool", "servers", "balancer pool to register in")
+var weight = flag.Int("weight", 1, "weight of this server in its pool")
+var tags = flag.String("tags", "", "comma-separated key=value tags of this server, e.g. zone=a")
+var heartbeat = flag.Duration("heartbeat", 5*time.Second, "interval of heartbeats to the balancer")
+var shutdownDelay = flag.Duration("shutdown-delay", 5*time.Second, "time to finish requests after deregistering")
+var capacity = flag.Int("capacity", 0, "concurrent requests this server handles comfortably, reported on /health; 0 disables load reports")
+var cacheMaxAge = flag.Int("cache-max-age", 0, "max-age in seconds of data responses for caches, 0 disables caching")
+
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
@@ -36,13 +51,23 @@ func main() {
 		log.Fatalf("Error putting data to db: %s", strconv.Itoa(resp.StatusCode))
 	}
 
+	exporter, err := tracing.NewExporter(*spansFile, *otlpEndpoint, "server")
+	if err != nil {
+		log.Fatalf("Error creating span exporter: %s", err)
+	}
+	tracer := &tracing.Tracer{Service: "server", Exporter: exporter}
+
 	h := new(http.ServeMux)
 
+	load := &loadTracker{capacity: *capacity}
+
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
 		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
 			rw.WriteHeader(http.StatusInternalServerError)
 			_, _ = rw.Write([]byte("FAILURE"))
+		} else if load.capacity > 0 {
+			load.report(rw, r)
 		} else {
 			rw.WriteHeader(http.StatusOK)
 			_, _ = rw.Write([]byte("OK"))
@@ -63,7 +88,7 @@ func main() {
 
 		if !ok || len(keys[0]) < 1 {
 			rw.WriteHeader(http.StatusBadRequest)
-			log.Println("Url Param 'key' is missing")
+			tracing.Logf(r.Context(), "Url Param 'key' is missing")
 			return
 		}
 		key := keys[0]
@@ -74,9 +99,12 @@ func main() {
 			t = types[0]
 		}
 
-		log.Println("Key: " + key + ", type: " + t)
+		tracing.Logf(r.Context(), "Key: %s, type: %s", key, t)
 
-		resp, err := http.Get(*db + key + "?type=" + t)
+		dbReq, _ := http.NewRequestWithContext(r.Context(), "GET", *db + key + "?type=" + t, nil)
+		span := tracer.Inject(r.Context(), dbReq)
+		resp, err := http.DefaultClient.Do(dbReq)
+		span.Finish()
 		if err != nil {
 			log.Fatalf("Error getting data from db: %s", err)
 			rw.WriteHeader(http.StatusInternalServerError)
@@ -97,6 +125,9 @@ func main() {
 		}
 
 		rw.Header().Set("content-type", "application/json")
+		if *cacheMaxAge > 0 {
+			rw.Header().Set("cache-control", fmt.Sprintf("public, max-age=%d", *cacheMaxAge))
+		}
 		rw.WriteHeader(http.StatusOK)
 		_, err = rw.Write(buf)
 		if err != nil {
@@ -106,7 +137,34 @@ func main() {
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, tracer.Middleware(load.track(h)))
 	server.Start()
+	if *socket != "" {
+		httptools.CreateUnixServer(*socket, tracer.Middleware(load.track(h)), nil).Start()
+	}
+
+	var registrar *registrar
+	if *register != "" {
+		address := *advertise
+		if address == "" {
+			hostname, _ := os.Hostname()
+			address = fmt.Sprintf("%s:%d", hostname, *port)
+		}
+		registrar = newRegistrar(*register, registration{
+			Pool:    *poolName,
+			Address: address,
+			Weight:  *weight,
+			Tags:    parseTags(*tags),
+			TTLSec:  int((3 * *heartbeat).Seconds()),
+		}, *adminToken, *heartbeat)
+		registrar.start()
+	}
 	signal.WaitForTerminationSignal()
+	if registrar != nil {
+		if err := registrar.deregister(); err != nil {
+			log.Printf("Failed to deregister from the balancer: %s", err)
+		} else {
+			time.Sleep(*shutdownDelay)
+		}
+	}
 }
@@ -5,5 +5,6 @@ go 1.15
 require (
 	github.com/MaryLynJuana/KPI_Assembly_System v0.0.0-20210429121941-069d072b648f // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
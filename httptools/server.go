@@ -3,7 +3,9 @@ package httptools
 import (
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
@@ -13,17 +15,68 @@ type Server interface {
 
 type server struct {
 	httpServer *http.Server
+	wrap       func(net.Listener) net.Listener
+	// socket is the path of the unix domain socket to listen on instead of
+	// the TCP address.
+	socket string
 }
 
 func (s server) Start() {
 	go func() {
 		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		err := s.listenAndServe()
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
+func (s server) listenAndServe() error {
+	if s.wrap == nil && s.socket == "" {
+		return s.httpServer.ListenAndServe()
+	}
+	l, err := s.listen()
+	if err != nil {
+		return err
+	}
+	if s.wrap != nil {
+		l = s.wrap(l)
+	}
+	return s.httpServer.Serve(l)
+}
+
+func (s server) listen() (net.Listener, error) {
+	if s.socket == "" {
+		return net.Listen("tcp", s.httpServer.Addr)
+	}
+	// A socket file left by a previous run would fail the listen, any other
+	// file at the path is kept.
+	if info, err := os.Lstat(s.socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", s.socket)
+		}
+		if err := os.Remove(s.socket); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", s.socket)
+}
+
+// CreateUnixServer creates a server listening on a unix domain socket, e.g.
+// for sidecars on the same host.
+func CreateUnixServer(socket string, handler http.Handler, wrap func(net.Listener) net.Listener) Server {
+	s := CreateServerWithListener(0, handler, wrap).(server)
+	s.socket = socket
+	return s
+}
+
 func CreateServer(port int, handler http.Handler) Server {
+	return CreateServerWithListener(port, handler, nil)
+}
+
+// CreateServerWithListener creates a server whose listener is passed through
+// wrap before serving, e.g. to parse PROXY protocol headers.
+func CreateServerWithListener(port int, handler http.Handler, wrap func(net.Listener) net.Listener) Server {
 	return server{
 		httpServer: &http.Server{
 			Addr:           fmt.Sprintf(":%d", port),
@@ -32,5 +85,6 @@ func CreateServer(port int, handler http.Handler) Server {
 			WriteTimeout:   10 * time.Second,
 			MaxHeaderBytes: 1 << 20,
 		},
+		wrap: wrap,
 	}
 }
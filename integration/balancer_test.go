@@ -25,7 +25,10 @@ func TestBalancer(t *testing.T) {
 		compare := resp.Header.Get("lb-from")
 		for j := 0; j < 5; j++ {
 			resp, err = client.Get(route)
-			assert.Equal(t, compare, resp.Header.Get("lb-from"))
+			assert.Equal(t, compare, resp.Header.Get("lb-from"),
+				"strategy %s, affinity hash %s, tried %s, timing %s",
+				resp.Header.Get("lb-strategy"), resp.Header.Get("lb-affinity-hash"),
+				resp.Header.Get("lb-tried"), resp.Header.Get("Server-Timing"))
 			body, _ := ioutil.ReadAll(resp.Body)
 			assert.NotEmpty(t, string(body))
 			assert.Nil(t, err)
@@ -0,0 +1,245 @@
+// Package proxyproto implements the PROXY protocol v1 and v2 used by layer-4
+// load balancers to pass the original client address to the next hop.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	v1MaxLength = 107
+
+	v2CmdLocal   = 0x0
+	v2CmdProxy   = 0x1
+	v2FamilyTCP4 = 0x11
+	v2FamilyTCP6 = 0x21
+)
+
+var ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+
+// ReadHeader parses a v1 or v2 header from r. Both addresses are nil when the
+// header does not carry them (v1 UNKNOWN, v2 LOCAL or non-TCP families).
+func ReadHeader(r *bufio.Reader) (src, dst net.Addr, err error) {
+	prefix, err := r.Peek(len(v2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+	if bytes.Equal(prefix, v2Signature) {
+		return readV2(r)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readV1(r)
+	}
+	return nil, nil, ErrInvalidHeader
+}
+
+func readV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrInvalidHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrInvalidHeader
+	}
+	src, err := tcpAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := tcpAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil || p < 0 || p > 65535 {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: p}, nil
+}
+
+func readV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, ErrInvalidHeader
+	}
+	command := header[12] & 0xf
+	family := header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	if command == v2CmdLocal {
+		return nil, nil, nil
+	}
+	if command != v2CmdProxy {
+		return nil, nil, ErrInvalidHeader
+	}
+
+	switch family {
+	case v2FamilyTCP4:
+		if len(payload) < 12 {
+			return nil, nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))},
+			&net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))},
+			nil
+	case v2FamilyTCP6:
+		if len(payload) < 36 {
+			return nil, nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))},
+			&net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))},
+			nil
+	}
+	// Other families (UDP, unix sockets) are accepted without addresses.
+	return nil, nil, nil
+}
+
+// WriteHeader writes a header of the given version (1 or 2) for a connection
+// from src to dst. Addresses that are not TCP are sent as UNKNOWN/LOCAL.
+func WriteHeader(w io.Writer, version int, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+	known := srcOK && dstOK
+	ipv4 := known && srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil
+
+	switch version {
+	case 1:
+		if !known {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n", proto, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)
+		return err
+	case 2:
+		var buf bytes.Buffer
+		buf.Write(v2Signature)
+		if !known {
+			buf.Write([]byte{0x20 | v2CmdLocal, 0, 0, 0})
+			_, err := w.Write(buf.Bytes())
+			return err
+		}
+		var payload []byte
+		family := byte(v2FamilyTCP6)
+		if ipv4 {
+			family = v2FamilyTCP4
+			payload = append(append(payload, srcTCP.IP.To4()...), dstTCP.IP.To4()...)
+		} else {
+			payload = append(append(payload, srcTCP.IP.To16()...), dstTCP.IP.To16()...)
+		}
+		payload = append(payload, byte(srcTCP.Port>>8), byte(srcTCP.Port), byte(dstTCP.Port>>8), byte(dstTCP.Port))
+		buf.Write([]byte{0x20 | v2CmdProxy, family, byte(len(payload) >> 8), byte(len(payload))})
+		buf.Write(payload)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+	return fmt.Errorf("proxyproto: unsupported version %d", version)
+}
+
+// Listener requires a PROXY protocol header on every accepted connection.
+type Listener struct {
+	net.Listener
+	// Timeout limits the time to receive the header.
+	Timeout time.Duration
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: conn, timeout: l.Timeout}, nil
+}
+
+// Conn reads the header lazily on the first Read or address lookup, so a
+// slow client does not block the accept loop.
+type Conn struct {
+	net.Conn
+	timeout time.Duration
+
+	once   sync.Once
+	reader *bufio.Reader
+	src    net.Addr
+	dst    net.Addr
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.reader = bufio.NewReader(c.Conn)
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+			defer c.Conn.SetReadDeadline(time.Time{})
+		}
+		c.src, c.dst, c.err = ReadHeader(c.reader)
+	})
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.src != nil {
+		return c.src
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+	if c.dst != nil {
+		return c.dst
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite half-closes the underlying connection when it supports that.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
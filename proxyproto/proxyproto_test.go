@@ -0,0 +1,86 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderRoundTrip(t *testing.T) {
+	cases := []struct {
+		src, dst *net.TCPAddr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("172.19.0.5"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("172.19.0.2"), Port: 8090}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 8090}},
+	}
+	for _, version := range []int{1, 2} {
+		for _, c := range cases {
+			var buf bytes.Buffer
+			if err := WriteHeader(&buf, version, c.src, c.dst); err != nil {
+				t.Fatal(err)
+			}
+			buf.WriteString("GET / HTTP/1.1\r\n")
+			r := bufio.NewReader(&buf)
+			src, dst, err := ReadHeader(r)
+			if err != nil {
+				t.Fatalf("v%d: %s", version, err)
+			}
+			if src.String() != c.src.String() || dst.String() != c.dst.String() {
+				t.Errorf("v%d: unexpected addresses %s -> %s", version, src, dst)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "GET / HTTP/1.1\r\n" {
+				t.Errorf("v%d: header consumed payload: %q", version, rest)
+			}
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	for _, header := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"PROXY TCP4 1.2.3.4\r\n\r\n",
+		"PROXY TCP4 1.2.3.4 5.6.7.8 1 99999\r\n",
+	} {
+		if _, _, err := ReadHeader(bufio.NewReader(strings.NewReader(header))); err == nil {
+			t.Errorf("Header %q accepted", header)
+		}
+	}
+	src, _, err := ReadHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN\r\n")))
+	if err != nil || src != nil {
+		t.Errorf("Unexpected UNKNOWN result: %v %v", src, err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := &Listener{Listener: l, Timeout: time.Second}
+	defer pl.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("PROXY TCP4 10.0.0.7 10.0.0.1 4000 80\r\nhello"))
+	}()
+
+	conn, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if addr := conn.RemoteAddr().String(); addr != "10.0.0.7:4000" {
+		t.Errorf("Unexpected remote address %s", addr)
+	}
+	if data, _ := ioutil.ReadAll(conn); string(data) != "hello" {
+		t.Errorf("Unexpected payload %q", data)
+	}
+}
@@ -13,3 +13,15 @@ func WaitForTerminationSignal() {
 	<-intChannel
 	log.Println("Shutting down...")
 }
+
+// OnReload calls reload every time the process receives SIGHUP.
+func OnReload(reload func()) {
+	hupChannel := make(chan os.Signal, 1)
+	signal.Notify(hupChannel, syscall.SIGHUP)
+	go func() {
+		for range hupChannel {
+			log.Println("Reloading...")
+			reload()
+		}
+	}()
+}
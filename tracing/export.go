@@ -0,0 +1,172 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Exporter interface {
+	Export(s *Span)
+}
+
+type fileExporter struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileExporter appends finished spans to path as JSON lines.
+func NewFileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{file: f}, nil
+}
+
+func (e *fileExporter) Export(s *Span) {
+	s.mu.Lock()
+	line, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.file.Write(append(line, '\n'))
+}
+
+const (
+	otlpBatchSize     = 100
+	otlpFlushInterval = time.Second
+	otlpQueueSize     = 1000
+)
+
+type otlpExporter struct {
+	endpoint string
+	service  string
+	spans    chan *Span
+	client   *http.Client
+}
+
+// NewOTLPExporter sends spans in batches to an OTLP/HTTP JSON endpoint such
+// as http://localhost:4318/v1/traces. Spans are dropped when the queue is
+// full so tracing never slows requests down.
+func NewOTLPExporter(endpoint, service string) Exporter {
+	e := &otlpExporter{
+		endpoint: endpoint,
+		service:  service,
+		spans:    make(chan *Span, otlpQueueSize),
+		client:   &http.Client{Timeout: 5 * time.Second},
+	}
+	go e.run()
+	return e
+}
+
+func (e *otlpExporter) Export(s *Span) {
+	select {
+	case e.spans <- s:
+	default:
+	}
+}
+
+func (e *otlpExporter) run() {
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < otlpBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		e.send(batch)
+		batch = nil
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+}
+
+var otlpKinds = map[string]int{"server": 2, "client": 3}
+
+func (e *otlpExporter) send(batch []*Span) {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		s.mu.Lock()
+		spans[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              otlpKinds[s.Kind],
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		for k, v := range s.Attributes {
+			spans[i].Attributes = append(spans[i].Attributes, otlpAttribute{k, otlpValue{v}})
+		}
+		s.mu.Unlock()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []otlpAttribute{{"service.name", otlpValue{e.service}}},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{"spans": spans},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to export spans: %s", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// NewExporter returns the exporter selected by the command line: a JSON lines
+// file, an OTLP endpoint, or nil when span export is disabled.
+func NewExporter(file, otlpEndpoint, service string) (Exporter, error) {
+	if file != "" {
+		return NewFileExporter(file)
+	}
+	if otlpEndpoint != "" {
+		return NewOTLPExporter(otlpEndpoint, service), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,203 @@
+// Package tracing propagates request IDs and W3C trace context between the
+// balancer, the servers and the database, and records spans.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RequestIDHeader   = "X-Request-ID"
+	TraceParentHeader = "traceparent"
+
+	maxRequestIDLength = 128
+)
+
+// SpanContext is the part of a span propagated in the traceparent header.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+	Flags   string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceParent parses a version 00 traceparent header value.
+func ParseTraceParent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || parts[0] != "00" ||
+		!isHex(parts[1], 32) || !isHex(parts[2], 16) || !isHex(parts[3], 2) ||
+		parts[1] == strings.Repeat("0", 32) || parts[2] == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	return SpanContext{TraceID: parts[1], SpanID: parts[2], Flags: parts[3]}, true
+}
+
+func isHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func randomHex(bytes int) string {
+	b := make([]byte, bytes)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func NewRequestID() string {
+	return randomHex(16)
+}
+
+// Span is a timed operation of one service within a trace.
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Service    string            `json:"service"`
+	Kind       string            `json:"kind"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	flags    string
+	mu       sync.Mutex
+	exporter Exporter
+}
+
+func (s *Span) Context() SpanContext {
+	return SpanContext{TraceID: s.TraceID, SpanID: s.SpanID, Flags: s.flags}
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Attributes == nil {
+		s.Attributes = map[string]string{}
+	}
+	s.Attributes[key] = value
+}
+
+// Finish ends the span and hands it to the exporter.
+func (s *Span) Finish() {
+	s.mu.Lock()
+	s.End = time.Now()
+	s.mu.Unlock()
+	if s.exporter != nil {
+		s.exporter.Export(s)
+	}
+}
+
+// Tracer creates spans of one service.
+type Tracer struct {
+	Service  string
+	Exporter Exporter
+}
+
+// StartSpan starts a child of parent, or a new trace when parent is invalid.
+func (t *Tracer) StartSpan(name, kind string, parent SpanContext) *Span {
+	s := &Span{
+		SpanID:   randomHex(8),
+		Name:     name,
+		Service:  t.Service,
+		Kind:     kind,
+		Start:    time.Now(),
+		flags:    "01",
+		exporter: t.Exporter,
+	}
+	if parent.IsValid() {
+		s.TraceID, s.ParentID, s.flags = parent.TraceID, parent.SpanID, parent.Flags
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return s
+}
+
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	requestIDKey
+)
+
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey).(*Span)
+	return s
+}
+
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Middleware accepts or generates the request ID, continues the trace from
+// the traceparent header and wraps the request in a server span.
+func (t *Tracer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = NewRequestID()
+			r.Header.Set(RequestIDHeader, requestID)
+		}
+		parent, _ := ParseTraceParent(r.Header.Get(TraceParentHeader))
+		span := t.StartSpan(r.Method+" "+r.URL.Path, "server", parent)
+		span.SetAttribute("request_id", requestID)
+		defer span.Finish()
+
+		rw.Header().Set(RequestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey, requestID)
+		ctx = context.WithValue(ctx, spanKey, span)
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// Inject starts a client span for an outgoing request made while handling
+// ctx and sets the propagation headers on req. The caller finishes the span.
+func (t *Tracer) Inject(ctx context.Context, req *http.Request) *Span {
+	var parent SpanContext
+	if s := FromContext(ctx); s != nil {
+		parent = s.Context()
+	}
+	span := t.StartSpan(req.Method+" "+req.URL.Host, "client", parent)
+	req.Header.Set(TraceParentHeader, span.Context().TraceParent())
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+		span.SetAttribute("request_id", id)
+	}
+	return span
+}
+
+// Logf logs with the request ID and trace ID of ctx, so one request can be
+// followed across processes.
+func Logf(ctx context.Context, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	id := RequestID(ctx)
+	if s := FromContext(ctx); s != nil {
+		log.Printf("[request_id=%s trace_id=%s] %s", id, s.TraceID, msg)
+	} else if id != "" {
+		log.Printf("[request_id=%s] %s", id, msg)
+	} else {
+		log.Print(msg)
+	}
+}
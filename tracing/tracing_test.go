@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, ok := ParseTraceParent(value)
+	if !ok || sc.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID != "00f067aa0ba902b7" {
+		t.Fatalf("Unexpected span context %+v", sc)
+	}
+	if sc.TraceParent() != value {
+		t.Errorf("Unexpected traceparent %s", sc.TraceParent())
+	}
+	for _, invalid := range []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+	} {
+		if _, ok := ParseTraceParent(invalid); ok {
+			t.Errorf("Invalid traceparent %q accepted", invalid)
+		}
+	}
+}
+
+type collector []*Span
+
+func (c *collector) Export(s *Span) {
+	*c = append(*c, s)
+}
+
+func TestMiddlewarePropagation(t *testing.T) {
+	spans := &collector{}
+	tracer := &Tracer{Service: "lb", Exporter: spans}
+
+	var outgoing *http.Request
+	handler := tracer.Middleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		outgoing = httptest.NewRequest("GET", "http://server1:8080/api/v1/some-data", nil)
+		tracer.Inject(r.Context(), outgoing).Finish()
+	}))
+
+	r := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+	r.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, r)
+
+	requestID := rw.Header().Get(RequestIDHeader)
+	if requestID == "" {
+		t.Fatal("Request ID was not generated")
+	}
+	if outgoing.Header.Get(RequestIDHeader) != requestID {
+		t.Errorf("Request ID was not propagated")
+	}
+	if len(*spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(*spans))
+	}
+	client, server := (*spans)[0], (*spans)[1]
+	if server.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentID != "00f067aa0ba902b7" {
+		t.Errorf("Server span does not continue the trace: %+v", server)
+	}
+	if client.ParentID != server.SpanID || client.TraceID != server.TraceID {
+		t.Errorf("Client span is not a child of the server span: %+v", client)
+	}
+	if sc, _ := ParseTraceParent(outgoing.Header.Get(TraceParentHeader)); sc.SpanID != client.SpanID {
+		t.Errorf("Outgoing traceparent does not carry the client span")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := &Tracer{Service: "db", Exporter: exporter}
+	tracer.StartSpan("GET /db/oymate", "server", SpanContext{}).Finish()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var span Span
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &span) != nil {
+		t.Fatal("Span was not exported")
+	}
+	if span.Service != "db" || span.Name != "GET /db/oymate" {
+		t.Errorf("Unexpected span %s of %s", span.Name, span.Service)
+	}
+}